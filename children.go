@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/mildred/nomadspace/ns"
+)
+
+// childSpace is a child nomadspace running from a sub-directory of the input
+// directory.
+type childSpace struct {
+	ns     *NomadSpace
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// childName returns the name of the child nomadspace for a sub-directory
+func childName(dir string) string {
+	return strings.TrimSuffix(dir, ".nomad")
+}
+
+// childEnvName returns the template environment variable containing the id
+// of the child nomadspace, for example NS_MY_APP for my-app.nomad
+func childEnvName(dir string) string {
+	name := strings.ToUpper(childName(dir))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	return "NS_" + name
+}
+
+// newChild returns the child nomadspace for a sub-directory. Its id is
+// derived from the prefixed directory name, the same way a nomadspace job is
+// derived from its job name.
+func newChild(parent *NomadSpace, dir string, env map[string]string) *NomadSpace {
+	var child = *parent
+	child.Id = ns.Child(parent.Id, childName(dir))
+	child.Parent = parent.Id
+	child.Depth = parent.Depth + 1
+	child.InputDir = path.Join(parent.InputDir, dir)
+	child.Env = env
+	child.RenderedDir = path.Join(parent.RenderedDir, dir)
+	child.jobState = newJobState()
+	return &child
+}
+
+// startChildren starts the child nomadspaces for the given sub-directories
+// (with their inherited environment) that are not running yet, restarts
+// those whose environment changed and stops those whose sub-directory
+// disappeared. It returns the template environment variables with the child
+// ids.
+func (ns *NomadSpace) startChildren(ctx context.Context, l hclog.Logger, inputDir string, dirs map[string]map[string]string) map[string]string {
+	var env = map[string]string{}
+	var names []string
+
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	for _, dir := range names {
+		if c, ok := ns.children[dir]; ok {
+			if reflect.DeepEqual(c.ns.Env, dirs[dir]) {
+				env[childEnvName(dir)] = c.ns.Id
+				continue
+			}
+			l.Info("Child environment changed, restarting nomadspace", "dir", dir, "nomadspace", c.ns.Id)
+			ns.mu.Lock()
+			delete(ns.children, dir)
+			ns.mu.Unlock()
+			// Keep the child jobs running, they are taken over by the
+			// restarted child nomadspace
+			c.ns.Teardown = false
+			c.cancel()
+			<-c.done
+		}
+
+		child := newChild(ns, dir, dirs[dir])
+		env[childEnvName(dir)] = child.Id
+
+		err := os.MkdirAll(child.RenderedDir, 0700)
+		if err != nil {
+			l.Error("Child failed", "dir", dir, "error", err)
+			continue
+		}
+
+		cl := l.Named(childName(dir))
+		cl.Info("Starting child NomadSpace", "nomadspace", child.Id, "parent", child.Parent, "dir", path.Join(inputDir, dir))
+
+		cctx, cancel := context.WithCancel(ctx)
+		c := &childSpace{
+			ns:     child,
+			cancel: cancel,
+			done:   make(chan error, 1),
+		}
+		ns.mu.Lock()
+		ns.children[dir] = c
+		ns.mu.Unlock()
+
+		go func(dir string) {
+			err := c.ns.exec(cctx, cl, path.Join(inputDir, dir))
+			if err != nil && cctx.Err() == nil {
+				cl.Error("Child NomadSpace failed", "error", err)
+			}
+			c.done <- err
+		}(dir)
+	}
+
+	var removed []string
+	for dir := range ns.children {
+		if _, ok := dirs[dir]; !ok {
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(removed)
+
+	for _, dir := range removed {
+		c := ns.children[dir]
+		ns.mu.Lock()
+		delete(ns.children, dir)
+		ns.mu.Unlock()
+		l.Info("Child removed, stopping nomadspace", "dir", dir, "nomadspace", c.ns.Id)
+		c.cancel()
+		<-c.done
+		if !c.ns.Teardown {
+			if err := c.ns.teardown(l); err != nil {
+				l.Error("Child teardown failed", "dir", dir, "error", err)
+			}
+		}
+	}
+
+	return env
+}
+
+// stopChildren stops all child nomadspaces and waits for them to terminate
+func (ns *NomadSpace) stopChildren() error {
+	var err error
+	for dir, c := range ns.children {
+		c.cancel()
+		if e := <-c.done; e != nil && e != context.Canceled {
+			err = multierror.Append(err, fmt.Errorf("child %v, %v", dir, e)).ErrorOrNil()
+		}
+		ns.mu.Lock()
+		delete(ns.children, dir)
+		ns.mu.Unlock()
+	}
+	return err
+}
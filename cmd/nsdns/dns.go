@@ -4,12 +4,14 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
 	"github.com/mildred/nomadspace/dns"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func stringEnv(name, defVal string) string {
@@ -22,10 +24,12 @@ func stringEnv(name, defVal string) string {
 
 func main() {
 	var args nsdns.Args
+	var metricsListen string
 	flag.StringVar(&args.ConsulServer, "consul-server", "127.0.0.1:8600", "Consul DNS server")
 	flag.StringVar(&args.Listen, "listen", stringEnv("NSDNS_LISTEN_ADDR", "127.0.0.1:9653"), "Listen address [NSDNS_LISTEN_ADDR]")
 	flag.StringVar(&args.Domain, "domain", stringEnv("NSDNS_DOMAIN", "ns-consul."), "Domain to serve [NSDNS_DOMAIN]")
 	flag.StringVar(&args.ConsulDomain, "consul-domain", stringEnv("NSDNS_CONSUL_DOMAIN", "consul."), "Domain to recurse to consul [NSDNS_CONSUL_DOMAIN]")
+	flag.StringVar(&metricsListen, "metrics-listen", stringEnv("NSDNS_METRICS_LISTEN", ""), "Listen address for Prometheus /metrics, disabled if empty [NSDNS_METRICS_LISTEN]")
 	flag.Parse()
 
 	if !strings.HasSuffix(args.Domain, ".") {
@@ -42,6 +46,16 @@ func main() {
 		signal.Stop(sig)
 	}()
 
+	if metricsListen != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Printf("[INFO] metrics: Listening on %v...", metricsListen)
+			if err := http.ListenAndServe(metricsListen, nil); err != nil {
+				log.Printf("[ERR] metrics: %v", err)
+			}
+		}()
+	}
+
 	err := nsdns.Run(ctx, &args)
 	if err != nil {
 		log.Printf("Error: %v", err)
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+)
+
+// ConfigFile is the configuration file looked up in the input directory when
+// no configuration file is given
+const ConfigFile = "nomadspace.hcl"
+
+// configBlocks are the blocks of the configuration file. Options in a block
+// correspond to the flags prefixed with the block name, the enabled option
+// corresponds to the flag named after the block.
+var configBlocks = []string{"nomad", "consul", "vault", "template", "submit", "render", "nsdns", "dnsmasq"}
+
+// flagEnv matches the environment variables of a flag, listed in brackets at
+// the end of its usage
+var flagEnv = regexp.MustCompile(`\[([A-Z0-9_, ]+)\]$`)
+
+// flagEnvNames returns the environment variables a flag defaults to
+func flagEnvNames(f *flag.Flag) []string {
+	m := flagEnv.FindStringSubmatch(f.Usage)
+	if m == nil {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(m[1], ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+// configKey returns the block and the key of a flag in the configuration file
+func configKey(name string) (string, string) {
+	for _, block := range configBlocks {
+		if name == block {
+			return block, "enabled"
+		} else if strings.HasPrefix(name, block+"-") {
+			return block, strings.Replace(name[len(block)+1:], "-", "_", -1)
+		}
+	}
+	return "", strings.Replace(name, "-", "_", -1)
+}
+
+// configFlag returns the flag name of a key in a block of the configuration
+// file, the block being empty for top-level keys
+func configFlag(block, key string) string {
+	name := strings.Replace(key, "_", "-", -1)
+	if block == "" {
+		return name
+	} else if key == "enabled" {
+		return block
+	}
+	return block + "-" + name
+}
+
+// configValue converts a configuration value to a flag value. Lists are
+// converted to comma separated values.
+func configValue(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int, int64, float64:
+		return fmt.Sprint(v), true
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, ok := configValue(item)
+			if !ok {
+				return "", false
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), true
+	default:
+		return "", false
+	}
+}
+
+// configBlock returns the content of a configuration block, decoded as a map
+// from JSON or as a list of maps from HCL
+func configBlock(val interface{}) (map[string]interface{}, bool) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return v, true
+	case []map[string]interface{}:
+		var res = map[string]interface{}{}
+		for _, m := range v {
+			for k, item := range m {
+				res[k] = item
+			}
+		}
+		return res, true
+	default:
+		return nil, false
+	}
+}
+
+// readConfigFile reads a HCL or JSON configuration file and returns the flag
+// values it contains
+func readConfigFile(fname string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg map[string]interface{}
+	err = hcl.Decode(&cfg, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %v, %v", fname, err)
+	}
+
+	var values = map[string]string{}
+	var isBlock = map[string]bool{}
+	for _, block := range configBlocks {
+		isBlock[block] = true
+	}
+	for key, val := range cfg {
+		if block, ok := configBlock(val); ok && isBlock[key] {
+			for k, v := range block {
+				s, ok := configValue(v)
+				if !ok {
+					return nil, fmt.Errorf("Invalid value for %v.%v in %v", key, k, fname)
+				}
+				values[configFlag(key, k)] = s
+			}
+			continue
+		}
+		s, ok := configValue(val)
+		if !ok {
+			return nil, fmt.Errorf("Invalid value for %v in %v", key, fname)
+		}
+		values[configFlag("", key)] = s
+	}
+
+	return values, nil
+}
+
+// loadConfig sets the flags from the configuration file unless they are set
+// on the command line or in the environment, and returns the source of
+// each flag value: flag, env, file or default.
+func loadConfig(fs *flag.FlagSet, fname string) (map[string]string, error) {
+	var sources = map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = "default"
+		for _, name := range flagEnvNames(f) {
+			if _, ok := os.LookupEnv(name); ok {
+				sources[f.Name] = "env " + name
+				break
+			}
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+
+	if fname == "" {
+		return sources, nil
+	}
+
+	values, err := readConfigFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		source, ok := sources[name]
+		if !ok || name == "config" {
+			block, key := configKey(name)
+			if block != "" {
+				key = block + "." + key
+			}
+			return nil, fmt.Errorf("Unknown option %v in %v", key, fname)
+		} else if source != "default" {
+			continue
+		}
+		err = fs.Set(name, values[name])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %v in %v, %v", name, fname, err)
+		}
+		sources[name] = "file " + fname
+	}
+
+	return sources, nil
+}
+
+// configFileFor returns the configuration file to use: the given file or the
+// configuration file of the input directory if it exists.
+func configFileFor(fname, inputDir string) string {
+	if fname != "" {
+		return fname
+	}
+	if inputDir == "" {
+		inputDir = "."
+	}
+	fname = path.Join(inputDir, ConfigFile)
+	if _, err := os.Stat(fname); err == nil {
+		return fname
+	}
+	return ""
+}
+
+// dumpConfig writes the effective configuration in HCL format, with the
+// source of each value as a comment
+func dumpConfig(w io.Writer, fs *flag.FlagSet, sources map[string]string) {
+	var blocks = map[string][]*flag.Flag{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		block, _ := configKey(f.Name)
+		blocks[block] = append(blocks[block], f)
+	})
+
+	var format = func(indent string, f *flag.Flag) {
+		_, key := configKey(f.Name)
+		val := f.Value.String()
+		if (strings.HasSuffix(f.Name, "-token") || strings.HasSuffix(f.Name, "-secret-id")) && val != "" {
+			// Do not leak secrets
+			val = "<redacted>"
+		}
+		switch f.Value.(flag.Getter).Get().(type) {
+		case bool, int:
+		default:
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(w, "%s%s = %s # %s\n", indent, key, val, sources[f.Name])
+	}
+
+	for _, f := range blocks[""] {
+		format("", f)
+	}
+	for _, block := range configBlocks {
+		if len(blocks[block]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s {\n", block)
+		for _, f := range blocks[block] {
+			format("  ", f)
+		}
+		fmt.Fprintf(w, "}\n")
+	}
+}
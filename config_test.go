@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes a configuration file in a temporary directory
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "nomadspace-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(dir, name)
+	err = ioutil.WriteFile(fname, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestConfigKey(t *testing.T) {
+	var tests = []struct {
+		name  string
+		block string
+		key   string
+	}{
+		{"log-level", "", "log_level"},
+		{"dns-search", "", "dns_search"},
+		{"nomad", "nomad", "enabled"},
+		{"nomad-addr", "nomad", "addr"},
+		{"nomad-token-vault-path", "nomad", "token_vault_path"},
+		{"submit-retry-attempts", "submit", "retry_attempts"},
+		{"nsdns", "nsdns", "enabled"},
+		{"nsdns-consul-server", "nsdns", "consul_server"},
+		{"dnsmasq-extra-flags", "dnsmasq", "extra_flags"},
+	}
+	for _, test := range tests {
+		block, key := configKey(test.name)
+		if block != test.block || key != test.key {
+			t.Errorf("configKey(%q) = %q, %q, expected %q, %q", test.name, block, key, test.block, test.key)
+		}
+		if name := configFlag(block, key); name != test.name {
+			t.Errorf("configFlag(%q, %q) = %q, expected %q", block, key, name, test.name)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	var expected = map[string]string{
+		"log-level":             "debug",
+		"gc-keep":               "a,b",
+		"wait":                  "true",
+		"submit-retry-attempts": "3",
+		"nsdns":                 "true",
+		"nsdns-listen":          "127.0.0.1:53",
+	}
+	var tests = []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "nomadspace.hcl",
+			content: `
+log_level = "debug"
+gc_keep = ["a", "b"]
+wait = true
+
+submit {
+  retry_attempts = 3
+}
+
+nsdns {
+  enabled = true
+  listen = "127.0.0.1:53"
+}
+`,
+		},
+		{
+			name: "nomadspace.json",
+			content: `{
+  "log_level": "debug",
+  "gc_keep": ["a", "b"],
+  "wait": true,
+  "submit": {"retry_attempts": 3},
+  "nsdns": {"enabled": true, "listen": "127.0.0.1:53"}
+}`,
+		},
+	}
+	for _, test := range tests {
+		fname := writeConfig(t, test.name, test.content)
+		defer os.RemoveAll(path.Dir(fname))
+
+		values, err := readConfigFile(fname)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !reflect.DeepEqual(values, expected) {
+			t.Errorf("%s: values %v, expected %v", test.name, values, expected)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	const file = `
+nomad {
+  addr = "http://file:4646"
+}
+`
+	var tests = []struct {
+		name   string
+		args   []string
+		env    string
+		file   bool
+		value  string
+		source string
+	}{
+		{
+			name:   "default",
+			value:  "http://default:4646",
+			source: "default",
+		},
+		{
+			name:   "file over default",
+			file:   true,
+			value:  "http://file:4646",
+			source: "file",
+		},
+		{
+			name:   "env over file",
+			env:    "http://env:4646",
+			file:   true,
+			value:  "http://env:4646",
+			source: "env NOMADSPACE_TEST_NOMAD_ADDR",
+		},
+		{
+			name:   "flag over env and file",
+			args:   []string{"-nomad-addr", "http://flag:4646"},
+			env:    "http://env:4646",
+			file:   true,
+			value:  "http://flag:4646",
+			source: "flag",
+		},
+	}
+	for _, test := range tests {
+		os.Unsetenv("NOMADSPACE_TEST_NOMAD_ADDR")
+		if test.env != "" {
+			os.Setenv("NOMADSPACE_TEST_NOMAD_ADDR", test.env)
+		}
+
+		var addr string
+		var fs = flag.NewFlagSet("nomadspace", flag.ContinueOnError)
+		fs.StringVar(&addr, "nomad-addr", stringEnv("NOMADSPACE_TEST_NOMAD_ADDR", "http://default:4646"), "Nomad address [NOMADSPACE_TEST_NOMAD_ADDR]")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		var fname string
+		if test.file {
+			fname = writeConfig(t, ConfigFile, file)
+			defer os.RemoveAll(path.Dir(fname))
+		}
+
+		sources, err := loadConfig(fs, fname)
+		var source = sources["nomad-addr"]
+		if test.source == "file" {
+			test.source = "file " + fname
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if addr != test.value || source != test.source {
+			t.Errorf("%s: value %q from %q, expected %q from %q", test.name, addr, source, test.value, test.source)
+		}
+	}
+	os.Unsetenv("NOMADSPACE_TEST_NOMAD_ADDR")
+}
+
+func TestLoadConfigUnknownOption(t *testing.T) {
+	fname := writeConfig(t, ConfigFile, "nomad {\n  unknown = true\n}\n")
+	defer os.RemoveAll(path.Dir(fname))
+
+	var fs = flag.NewFlagSet("nomadspace", flag.ContinueOnError)
+	fs.String("nomad-addr", "", "Nomad address")
+	_, err := loadConfig(fs, fname)
+	if err == nil {
+		t.Errorf("expected an error for the unknown option nomad.unknown")
+	}
+}
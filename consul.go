@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consulOptions are the Consul connection settings. Empty settings keep the
+// defaults from the CONSUL_* environment variables.
+type consulOptions struct {
+	Addr       string
+	Token      string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+// address returns the Consul address without scheme and whether it uses
+// HTTPS, explicitly or because TLS files are given
+func (o *consulOptions) address() (string, bool) {
+	var addr = o.Addr
+	var ssl = o.CACert != "" || o.ClientCert != "" || o.ClientKey != ""
+	if strings.HasPrefix(addr, "https://") {
+		addr = strings.TrimPrefix(addr, "https://")
+		ssl = true
+	} else {
+		addr = strings.TrimPrefix(addr, "http://")
+	}
+	return addr, ssl
+}
+
+// apiConfig returns the Consul API client configuration
+func (o *consulOptions) apiConfig() *consulapi.Config {
+	var cfg = consulapi.DefaultConfig()
+	addr, ssl := o.address()
+	if addr != "" {
+		cfg.Address = addr
+	}
+	if ssl {
+		cfg.Scheme = "https"
+	}
+	if o.Token != "" {
+		cfg.Token = o.Token
+	}
+	if o.CACert != "" {
+		cfg.TLSConfig.CAFile = o.CACert
+	}
+	if o.ClientCert != "" {
+		cfg.TLSConfig.CertFile = o.ClientCert
+	}
+	if o.ClientKey != "" {
+		cfg.TLSConfig.KeyFile = o.ClientKey
+	}
+	return cfg
+}
+
+// templateConfig returns the consul-template Consul configuration
+func (o *consulOptions) templateConfig() *config.ConsulConfig {
+	var cfg = config.DefaultConsulConfig()
+	addr, ssl := o.address()
+	if addr != "" {
+		cfg.Address = config.String(addr)
+	}
+	if o.Token != "" {
+		cfg.Token = config.String(o.Token)
+	}
+	if ssl {
+		cfg.SSL.Enabled = config.Bool(true)
+	}
+	if o.CACert != "" {
+		cfg.SSL.CaCert = config.String(o.CACert)
+	}
+	if o.ClientCert != "" {
+		cfg.SSL.Cert = config.String(o.ClientCert)
+	}
+	if o.ClientKey != "" {
+		cfg.SSL.Key = config.String(o.ClientKey)
+	}
+	return cfg
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+// dependsOn returns the names of the jobs the job depends on, declared in the
+// "ns.depends_on" metadata as a comma separated list.
+func dependsOn(job *api.Job) []string {
+	var deps []string
+	for _, dep := range strings.Split(job.Meta["ns.depends_on"], ",") {
+		dep = strings.TrimSpace(dep)
+		if dep != "" {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// sortJobs returns the source file names of the jobs in an order where
+// dependencies come before the jobs depending on them. Dependencies on jobs
+// that are not in the list are ignored. If dependencies form a cycle, it
+// fails and returns the order of the jobs that do not depend on the cycle.
+func sortJobs(jobs map[string]*api.Job) ([]string, error) {
+	var fnames []string
+	var byName = map[string]string{}
+	for fname, job := range jobs {
+		fnames = append(fnames, fname)
+		if job.ID != nil {
+			byName[*job.ID] = fname
+		}
+	}
+	sort.Strings(fnames)
+
+	var deps = map[string][]string{}
+	for _, fname := range fnames {
+		for _, dep := range dependsOn(jobs[fname]) {
+			if depFname, ok := byName[dep]; ok {
+				deps[fname] = append(deps[fname], depFname)
+			}
+		}
+	}
+
+	var order []string
+	var done = map[string]bool{}
+	for len(order) < len(fnames) {
+		var ready []string
+		for _, fname := range fnames {
+			if done[fname] {
+				continue
+			}
+			var waiting = false
+			for _, dep := range deps[fname] {
+				if !done[dep] {
+					waiting = true
+				}
+			}
+			if !waiting {
+				ready = append(ready, fname)
+			}
+		}
+		if len(ready) == 0 {
+			var cycle []string
+			for _, fname := range fnames {
+				if !done[fname] {
+					cycle = append(cycle, fname)
+				}
+			}
+			return order, fmt.Errorf("dependency cycle between %s", strings.Join(cycle, ", "))
+		}
+		for _, fname := range ready {
+			done[fname] = true
+			order = append(order, fname)
+		}
+	}
+
+	return order, nil
+}
+
+// depJobID returns the id of a job of the nomadspace from its name
+func (ns *NomadSpace) depJobID(name string) string {
+	if ns.NomadNamespace {
+		return name
+	}
+	return ns.prefix(name)
+}
+
+// waitDependency waits until the dependency is deployed successfully or its
+// services pass their Consul checks, depending on DependsWait.
+func (ns *NomadSpace) waitDependency(ctx context.Context, l hclog.Logger, fname, dep string) error {
+	id := ns.depJobID(dep)
+
+	ctx, cancel := context.WithTimeout(ctx, ns.WaitTimeout)
+	defer cancel()
+
+	l.Info("Waiting for dependency", "file", fname, "job", id)
+
+	var err error
+	switch ns.DependsWait {
+	case "deployment":
+		ns.mu.Lock()
+		evalID := ns.evals[id]
+		state := ns.states[id]
+		ns.mu.Unlock()
+		if state == JobSuccessful {
+			return nil
+		} else if evalID != "" {
+			_, err = ns.waitJob(ctx, l, dep, id, evalID)
+		} else {
+			err = ns.waitLatestDeployment(ctx, id)
+		}
+	case "consul":
+		err = ns.waitServices(ctx, l, id)
+	}
+
+	if err != nil {
+		return fmt.Errorf("dependency %v of %v, %v", id, fname, err)
+	}
+
+	l.Info("Dependency is ready", "file", fname, "job", id)
+	return nil
+}
+
+// waitLatestDeployment waits for the latest deployment of a job not
+// submitted by this process to be successful
+func (ns *NomadSpace) waitLatestDeployment(ctx context.Context, id string) error {
+	var index uint64
+	for {
+		q := ns.queryOptions()
+		q.WaitIndex = index
+		q.WaitTime = 5 * time.Second
+		d, meta, err := ns.nomadClient.Jobs().LatestDeployment(id, q)
+		if err != nil {
+			return err
+		}
+		index = meta.LastIndex
+
+		if d == nil {
+			// Jobs without update strategy have no deployments
+			return nil
+		}
+
+		switch d.Status {
+		case "successful":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("deployment %v %v, %v", d.ID, d.Status, d.StatusDescription)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("deployment %v still %v, %v", d.ID, d.Status, ctx.Err())
+		default:
+		}
+	}
+}
+
+// waitServices waits for every Consul service of a job to have at least one
+// instance passing its health checks
+func (ns *NomadSpace) waitServices(ctx context.Context, l hclog.Logger, id string) error {
+	job, _, err := ns.nomadClient.Jobs().Info(id, ns.queryOptions())
+	if err != nil {
+		return err
+	}
+
+	var services []string
+	for _, group := range job.TaskGroups {
+		for _, service := range group.Services {
+			services = append(services, service.Name)
+		}
+		for _, task := range group.Tasks {
+			for _, service := range task.Services {
+				services = append(services, service.Name)
+			}
+		}
+	}
+
+	for _, service := range services {
+		var index uint64
+		for {
+			entries, meta, err := ns.consulClient.Health().Service(service, "", true, &consulapi.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  5 * time.Second,
+			})
+			if err != nil {
+				return err
+			}
+			index = meta.LastIndex
+
+			if len(entries) > 0 {
+				l.Info("Dependency service is passing", "job", id, "service", service)
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("service %v not passing, %v", service, ctx.Err())
+			default:
+			}
+		}
+	}
+
+	return nil
+}
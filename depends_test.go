@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func dependsJob(id, dependsOn string) *api.Job {
+	var job = &api.Job{ID: &id}
+	if dependsOn != "" {
+		job.Meta = map[string]string{"ns.depends_on": dependsOn}
+	}
+	return job
+}
+
+func TestDependsOn(t *testing.T) {
+	var tests = []struct {
+		meta string
+		deps []string
+	}{
+		{"", nil},
+		{"db", []string{"db"}},
+		{"db,cache", []string{"db", "cache"}},
+		{" db , cache ,", []string{"db", "cache"}},
+		{",,", nil},
+	}
+	for _, test := range tests {
+		deps := dependsOn(dependsJob("app", test.meta))
+		if !reflect.DeepEqual(deps, test.deps) {
+			t.Errorf("dependsOn(%q) = %#v, expected %#v", test.meta, deps, test.deps)
+		}
+	}
+}
+
+func TestSortJobs(t *testing.T) {
+	var tests = []struct {
+		name  string
+		jobs  map[string]*api.Job
+		order []string
+		err   bool
+	}{
+		{
+			name: "no dependencies",
+			jobs: map[string]*api.Job{
+				"b.json": dependsJob("b", ""),
+				"a.json": dependsJob("a", ""),
+			},
+			order: []string{"a.json", "b.json"},
+		},
+		{
+			name: "dependency first",
+			jobs: map[string]*api.Job{
+				"a.json": dependsJob("app", "db"),
+				"b.json": dependsJob("db", ""),
+			},
+			order: []string{"b.json", "a.json"},
+		},
+		{
+			name: "chain",
+			jobs: map[string]*api.Job{
+				"a.json": dependsJob("web", "app"),
+				"b.json": dependsJob("app", "db,cache"),
+				"c.json": dependsJob("db", ""),
+				"d.json": dependsJob("cache", "db"),
+			},
+			order: []string{"c.json", "d.json", "b.json", "a.json"},
+		},
+		{
+			name: "missing dependency ignored",
+			jobs: map[string]*api.Job{
+				"a.json": dependsJob("app", "external"),
+				"b.json": dependsJob("db", ""),
+			},
+			order: []string{"a.json", "b.json"},
+		},
+		{
+			name: "cycle",
+			jobs: map[string]*api.Job{
+				"a.json": dependsJob("a", "b"),
+				"b.json": dependsJob("b", "a"),
+				"c.json": dependsJob("c", ""),
+				"d.json": dependsJob("d", "a"),
+			},
+			order: []string{"c.json"},
+			err:   true,
+		},
+		{
+			name: "self dependency",
+			jobs: map[string]*api.Job{
+				"a.json": dependsJob("a", "a"),
+			},
+			err: true,
+		},
+	}
+	for _, test := range tests {
+		order, err := sortJobs(test.jobs)
+		if test.err && err == nil {
+			t.Errorf("%s: expected a cycle error, got order %v", test.name, order)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%s: order %v, expected %v", test.name, order, test.order)
+		}
+	}
+}
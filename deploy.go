@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+// Final states of a submitted job
+const (
+	JobSuccessful   = "successful"
+	JobFailed       = "failed"
+	JobAutoReverted = "auto-reverted"
+	JobCancelled    = "cancelled"
+	JobTimeout      = "timeout"
+)
+
+// formatDeploymentState summarizes the deployment progress of task groups
+func formatDeploymentState(d *api.Deployment) string {
+	var groups []string
+	for group := range d.TaskGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var res []string
+	for _, group := range groups {
+		s := d.TaskGroups[group]
+		res = append(res, fmt.Sprintf("%s: %d/%d placed, %d healthy, %d unhealthy",
+			group, s.PlacedAllocs, s.DesiredTotal, s.HealthyAllocs, s.UnhealthyAllocs))
+	}
+	return strings.Join(res, "; ")
+}
+
+// waitDeployment follows a deployment until it terminates and returns the
+// final job state.
+func (ns *NomadSpace) waitDeployment(ctx context.Context, l hclog.Logger, fname, deploymentID string) (string, error) {
+	var index uint64
+	var progress string
+	for {
+		q := ns.queryOptions()
+		q.WaitIndex = index
+		q.WaitTime = 5 * time.Second
+		d, meta, err := ns.nomadClient.Deployments().Info(deploymentID, q)
+		if err != nil {
+			return JobFailed, fmt.Errorf("failed to get deployment %v, %v", deploymentID, err)
+		}
+		index = meta.LastIndex
+
+		if p := formatDeploymentState(d); p != progress {
+			progress = p
+			l.Info("Deployment progress", "file", fname, "job", d.JobID, "deployment", d.ID, "status", d.Status, "groups", progress)
+		}
+
+		switch d.Status {
+		case "successful":
+			return JobSuccessful, nil
+		case "failed":
+			// See DeploymentStatusDescriptionRollback in Nomad
+			if strings.Contains(d.StatusDescription, "rolling back") {
+				return JobAutoReverted, fmt.Errorf("deployment %v auto-reverted, %v", deploymentID, d.StatusDescription)
+			}
+			return JobFailed, fmt.Errorf("deployment %v failed, %v", deploymentID, d.StatusDescription)
+		case "cancelled":
+			return JobCancelled, fmt.Errorf("deployment %v cancelled, %v", deploymentID, d.StatusDescription)
+		}
+
+		select {
+		case <-ctx.Done():
+			return JobTimeout, fmt.Errorf("deployment %v still %v, %v", deploymentID, d.Status, ctx.Err())
+		default:
+		}
+	}
+}
+
+// waitAllocations follows the allocations created by an evaluation, for jobs
+// without deployments, until they are all running or terminated and returns
+// the final job state.
+func (ns *NomadSpace) waitAllocations(ctx context.Context, l hclog.Logger, fname, evalID string) (string, error) {
+	var index uint64
+	for {
+		q := ns.queryOptions()
+		q.WaitIndex = index
+		q.WaitTime = 5 * time.Second
+		allocs, meta, err := ns.nomadClient.Evaluations().Allocations(evalID, q)
+		if err != nil {
+			return JobFailed, fmt.Errorf("failed to get allocations of evaluation %v, %v", evalID, err)
+		}
+		index = meta.LastIndex
+
+		var pending, failed int
+		for _, alloc := range allocs {
+			switch alloc.ClientStatus {
+			case "pending":
+				pending += 1
+			case "failed", "lost":
+				failed += 1
+			}
+		}
+
+		if failed > 0 {
+			return JobFailed, fmt.Errorf("%d allocations of evaluation %v failed", failed, evalID)
+		} else if pending == 0 {
+			return JobSuccessful, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return JobTimeout, fmt.Errorf("%d allocations of evaluation %v still pending, %v", pending, evalID, ctx.Err())
+		default:
+		}
+	}
+}
+
+// waitJob follows the evaluation of a submitted job and the resulting
+// deployment or allocations until they terminate or the wait timeout
+// expires. It logs progress and returns the final job state.
+func (ns *NomadSpace) waitJob(ctx context.Context, l hclog.Logger, fname, jobID, evalID string) (state string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, ns.WaitTimeout)
+	defer cancel()
+
+	defer func() {
+		ns.mu.Lock()
+		ns.states[jobID] = state
+		ns.mu.Unlock()
+		if err != nil {
+			l.Error("Deployment failed", "file", fname, "job", jobID, "eval", evalID, "state", state, "error", err)
+		} else {
+			l.Info("Deployment done", "file", fname, "job", jobID, "eval", evalID, "state", state)
+		}
+	}()
+
+	eval, err := ns.waitEval(ctx, evalID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return JobTimeout, err
+		}
+		return JobFailed, err
+	} else if eval.Status != "complete" {
+		return JobFailed, fmt.Errorf("evaluation %v %v, %v", evalID, eval.Status, eval.StatusDescription)
+	}
+
+	logPlacementFailures(l, fname, jobID, eval)
+
+	if eval.DeploymentID != "" {
+		// The deployment tracks the allocations placed later on
+		return ns.waitDeployment(ctx, l, fname, eval.DeploymentID)
+	}
+
+	for {
+		state, err = ns.waitAllocations(ctx, l, fname, eval.ID)
+		if err != nil || eval.BlockedEval == "" {
+			return state, err
+		}
+
+		// Like nomad job run, wait for the allocations that could not be
+		// placed until the blocked evaluation is processed
+		l.Info("Waiting for blocked evaluation", "file", fname, "job", jobID, "eval", eval.BlockedEval)
+		eval, err = ns.waitEval(ctx, eval.BlockedEval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return JobTimeout, err
+			}
+			return JobFailed, err
+		} else if eval.Status != "complete" {
+			return JobFailed, fmt.Errorf("evaluation %v %v, %v", eval.ID, eval.Status, eval.StatusDescription)
+		}
+		logPlacementFailures(l, fname, jobID, eval)
+	}
+}
+
+// logPlacementFailures logs the task groups of the evaluation that could not
+// be placed. They are not failures of the job, the allocations are placed
+// once resources are available.
+func logPlacementFailures(l hclog.Logger, fname, jobID string, eval *api.Evaluation) {
+	var groups []string
+	for group := range eval.FailedTGAllocs {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		metric := eval.FailedTGAllocs[group]
+		l.Warn("Task group failed to place allocations", "file", fname, "job", jobID, "eval", eval.ID, "group", group, "allocations", metric.CoalescedFailures+1)
+	}
+}
+
+// waitBackground follows a submitted job like waitJob without blocking the
+// caller. A failure is reported on the waitErrs channel so that execOnce
+// stops with an error, unless the context is cancelled first.
+func (ns *NomadSpace) waitBackground(ctx context.Context, l hclog.Logger, fname, jobID, evalID string) {
+	_, err := ns.waitJob(ctx, l, fname, jobID, evalID)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	select {
+	case ns.waitErrs <- fmt.Errorf("failed to deploy %v as %v, %v", fname, jobID, err):
+	default:
+		// A failure is already pending
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +16,10 @@ import (
 
 const TTL = 60
 
+// Logger is the logger of the DNS server, messages are prefixed with their
+// level ([DEBUG], [INFO], [WARN] or [ERR])
+var Logger = log.New(os.Stderr, "", log.LstdFlags)
+
 var ShutdownTimeout time.Duration = 5 * time.Second
 var RecursorTimeout time.Duration = 5 * time.Second
 
@@ -85,7 +90,7 @@ func runServer(ctx context.Context, wg *sync.WaitGroup, net string, args *Args,
 		defer cancel()
 	}()
 
-	log.Printf("[INFO] dns: Listening on %v %v...", server.Net, server.Addr)
+	Logger.Printf("[INFO] dns: Listening on %v %v...", server.Net, server.Addr)
 	e <- server.ListenAndServe()
 }
 
@@ -109,15 +114,17 @@ func tail(elems []string) ([]string, string, error) {
 
 func (h *Handler) ServeGlobalRecursor(w dns.ResponseWriter, req *dns.Msg) {
 	res := Recurse(h.Context, w.RemoteAddr(), req, h.GlobalRecursors)
+	countQuery("ServeGlobalRecursor", res)
 	if err := w.WriteMsg(res); err != nil {
-		log.Printf("[WARN] dns: failed to respond: %v", err)
+		Logger.Printf("[WARN] dns: failed to respond: %v", err)
 	}
 }
 
 func (h *Handler) ServeConsulRecursor(w dns.ResponseWriter, req *dns.Msg) {
 	res := Recurse(h.Context, w.RemoteAddr(), req, h.ConsulRecursors)
+	countQuery("ServeConsulRecursor", res)
 	if err := w.WriteMsg(res); err != nil {
-		log.Printf("[WARN] dns: failed to respond: %v", err)
+		Logger.Printf("[WARN] dns: failed to respond: %v", err)
 	}
 }
 
@@ -125,7 +132,7 @@ func Recurse(ctx context.Context, raddr net.Addr, req *dns.Msg, recursors []stri
 	q := req.Question[0]
 	network := "udp"
 	defer func(s time.Time) {
-		log.Printf("[DEBUG] dns: request for %v (%s) (%v) from client %s (%s)",
+		Logger.Printf("[DEBUG] dns: request for %v (%s) (%v) from client %s (%s)",
 			q, network, time.Since(s), raddr.String(),
 			raddr.Network())
 	}(time.Now())
@@ -140,7 +147,11 @@ func Recurse(ctx context.Context, raddr net.Addr, req *dns.Msg, recursors []stri
 	var r *dns.Msg
 	var err error
 	for _, recursor := range recursors {
-		r, _, err = c.ExchangeContext(ctx, req, recursor)
+		var rtt time.Duration
+		r, rtt, err = c.ExchangeContext(ctx, req, recursor)
+		if err == nil {
+			recursorDuration.WithLabelValues(recursor).Observe(rtt.Seconds())
+		}
 		// Check if the response is valid and has the desired Response code
 		if r != nil && (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
 			// If we still have recursors to forward the query to,
@@ -155,11 +166,11 @@ func Recurse(ctx context.Context, raddr net.Addr, req *dns.Msg, recursors []stri
 			// Forward the response
 			return r
 		}
-		log.Printf("[ERR] dns: recurse failed: %v", err)
+		Logger.Printf("[ERR] dns: recurse failed: %v", err)
 	}
 
 	// If all resolvers fail, return a SERVFAIL message
-	log.Printf("[ERR] dns: all resolvers failed for %v from client %s (%s)",
+	Logger.Printf("[ERR] dns: all resolvers failed for %v from client %s (%s)",
 		q, raddr.String(), raddr.Network())
 	return ErrorResponse(req, dns.RcodeServerFailure)
 }
@@ -193,7 +204,7 @@ func (h *Handler) ServeConsulNS(w dns.ResponseWriter, req *dns.Msg) {
 	resp.RecursionAvailable = false
 
 	defer func(s time.Time) {
-		log.Printf("[DEBUG] dns: request for %v (%v) from client %s (%s)",
+		Logger.Printf("[DEBUG] dns: request for %v (%v) from client %s (%s)",
 			questionsStrings(req.Question), time.Since(s), w.RemoteAddr().String(),
 			w.RemoteAddr().Network())
 	}(time.Now())
@@ -264,15 +275,16 @@ func (h *Handler) ServeConsulNS(w dns.ResponseWriter, req *dns.Msg) {
 
 		recRes := Recurse(ctx, w.RemoteAddr(), recReq, h.ConsulRecursors)
 		if recRes.Rcode == dns.RcodeSuccess {
-			log.Printf("[DEBUG] dns: recurse %v on %v: %v",
+			Logger.Printf("[DEBUG] dns: recurse %v on %v: %v",
 				questionsStrings(req.Question), h.ConsulRecursors, resp.Answer)
 			resp.Answer = append(resp.Answer, recRes.Answer...)
 		} else {
-			log.Printf("[DEBUG] dns: recurse %v on %v failed with code %v",
+			Logger.Printf("[DEBUG] dns: recurse %v on %v failed with code %v",
 				questionsStrings(req.Question), h.ConsulRecursors, dns.RcodeToString[recRes.Rcode])
 		}
 	}
 
+	countQuery("ServeConsulNS", resp)
 	w.WriteMsg(resp)
 }
 
@@ -0,0 +1,34 @@
+package nsdns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nsdns",
+		Name:      "queries_total",
+		Help:      "DNS queries served, by handler and response code.",
+	}, []string{"handler", "rcode"})
+
+	recursorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nsdns",
+		Name:      "recursor_duration_seconds",
+		Help:      "Latency of queries forwarded to recursors, by recursor.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"recursor"})
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal, recursorDuration)
+}
+
+// countQuery counts a query served by a handler with the response code
+func countQuery(handler string, res *dns.Msg) {
+	rcode, ok := dns.RcodeToString[res.Rcode]
+	if !ok {
+		rcode = "UNKNOWN"
+	}
+	queriesTotal.WithLabelValues(handler, rcode).Inc()
+}
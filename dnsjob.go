@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// resolvConfPaths is the path, relative to the task directory, where the
+// namespaced resolv.conf is rendered for drivers that have no DNS settings.
+// For drivers running in a chroot, this is the resolv.conf seen by the task.
+var resolvConfPaths = map[string]string{
+	"exec":     "etc/resolv.conf",
+	"java":     "etc/resolv.conf",
+	"raw_exec": "local/resolv.conf",
+	"qemu":     "local/resolv.conf",
+	"docker":   "local/resolv.conf",
+	"podman":   "local/resolv.conf",
+}
+
+// dnsConfigKeys lists for drivers supporting them the task configuration keys
+// for DNS servers and DNS search domains.
+var dnsConfigKeys = map[string][2]string{
+	"docker": {"dns_servers", "dns_search_domains"},
+	"rkt":    {"dns_servers", "dns_search_domains"},
+	"podman": {"dns", "dns_search"},
+}
+
+// isBridgeNetwork returns true if the group uses a bridge network. In that
+// case, the tasks share the network namespace of the group and their driver
+// DNS settings cannot be used.
+func isBridgeNetwork(group *api.TaskGroup) bool {
+	for _, network := range group.Networks {
+		if network.Mode == "bridge" {
+			return true
+		}
+	}
+	return false
+}
+
+func appendConfigList(task *api.Task, key, val string) {
+	if val == "" {
+		return
+	}
+	if task.Config == nil {
+		task.Config = map[string]interface{}{}
+	}
+	task.Config[key] = append(toStringList(task.Config[key]), val)
+}
+
+// resolvConf returns the content of the namespaced resolv.conf
+func (ns *NomadSpace) resolvConf() string {
+	var b strings.Builder
+	if ns.DNSServer != "" {
+		fmt.Fprintf(&b, "nameserver %s\n", ns.DNSServer)
+	}
+	if ns.DNSSearch != "" {
+		fmt.Fprintf(&b, "search %s\n", ns.DNSSearch)
+	}
+	return b.String()
+}
+
+// namespaceDNS overrides the task DNS settings with the nomadspace DNS server
+// and search domain. Drivers with DNS settings are configured directly,
+// other drivers get a resolv.conf rendered by a template stanza.
+func (ns *NomadSpace) namespaceDNS(group *api.TaskGroup, task *api.Task) {
+	if ns.DNSServer == "" && ns.DNSSearch == "" {
+		return
+	}
+
+	bridge := isBridgeNetwork(group)
+	if keys, ok := dnsConfigKeys[task.Driver]; ok && !bridge {
+		appendConfigList(task, keys[0], ns.DNSServer)
+		appendConfigList(task, keys[1], ns.DNSSearch)
+		return
+	}
+
+	if ns.DNSSearch != "" {
+		// Honoured by the glibc resolver when resolv.conf cannot be changed
+		task.Env["LOCALDOMAIN"] = ns.DNSSearch
+	}
+
+	dest, ok := resolvConfPaths[task.Driver]
+	if !ok || ns.DNSServer == "" {
+		return
+	}
+
+	var data = ns.resolvConf()
+	var changeMode = "noop"
+	task.Templates = append(task.Templates, &api.Template{
+		EmbeddedTmpl: &data,
+		DestPath:     &dest,
+		ChangeMode:   &changeMode,
+	})
+	task.Env["NOMADSPACE_RESOLV_CONF"] = dest
+
+	if task.Driver == "docker" {
+		// Relative volumes are relative to the task directory
+		appendConfigList(task, "volumes", dest+":/etc/resolv.conf:ro")
+	}
+}
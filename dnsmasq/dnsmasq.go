@@ -1,12 +1,15 @@
 package dnsmasq
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
-	"os"
 	"os/exec"
 	"log"
+	"regexp"
 )
 
 type Args struct {
@@ -32,6 +35,40 @@ func dnsmasqHostPort(h string) string {
 	return strings.ReplaceAll(h, ":", "#")
 }
 
+// dnsmasqLog matches dnsmasq log lines, optionally prefixed by a syslog
+// timestamp, and captures the message
+var dnsmasqLog = regexp.MustCompile(`^(?:[A-Z][a-z]{2} [ 0-9]\d \d\d:\d\d:\d\d )?dnsmasq(?:-[a-z]+)?(?:\[\d+\])?: (.*)$`)
+
+// logLine returns a dnsmasq output line without the dnsmasq prefix and with
+// a log level prefix ([DEBUG], [INFO], [WARN] or [ERR]). Queries and replies
+// are logged at the debug level.
+func logLine(line string) string {
+	if m := dnsmasqLog.FindStringSubmatch(line); m != nil {
+		line = m[1]
+	}
+
+	lower := strings.ToLower(line)
+	switch {
+	case strings.HasPrefix(line, "query["),
+		strings.HasPrefix(line, "forwarded "),
+		strings.HasPrefix(line, "reply "),
+		strings.HasPrefix(line, "cached "),
+		strings.HasPrefix(line, "config "),
+		strings.HasPrefix(line, "validation "):
+		return "[DEBUG] " + line
+	case strings.HasPrefix(lower, "warning"):
+		return "[WARN] " + line
+	case strings.Contains(lower, "failed"),
+		strings.Contains(lower, "error"),
+		strings.Contains(lower, "cannot"),
+		strings.HasPrefix(lower, "bad "):
+		return "[ERR] " + line
+	default:
+		return "[INFO] " + line
+	}
+}
+
+// Run runs dnsmasq in the foreground, its output is logged line by line
 func Run(ctx context.Context, l *log.Logger, args *Args) error {
 	path, err := exec.LookPath("dnsmasq")
 	if err != nil {
@@ -66,12 +103,27 @@ func Run(ctx context.Context, l *log.Logger, args *Args) error {
 		l.Printf("\t%s", arg)
 	}
 
+	r, w := io.Pipe()
 	cmd := exec.Cmd{
 		Path: path,
 		Args: cmdArgs,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Stdout: w,
+		Stderr: w,
 	}
 
-	return cmd.Run()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			l.Print(logLine(scanner.Text()))
+		}
+		// Drain the output in case of scan errors (line too long)
+		io.Copy(ioutil.Discard, r)
+	}()
+
+	err = cmd.Run()
+	w.Close()
+	<-done
+	return err
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// EnvironmentFile is the name of the directory level environment file
+const EnvironmentFile = "environment"
+
+// jobBaseName returns the name of a job source file without its extensions,
+// for example "web" for "web.nomad.tmpl"
+func jobBaseName(name string) string {
+	name = strings.TrimSuffix(name, ".tmpl")
+	name = strings.TrimSuffix(name, ".json")
+	name = strings.TrimSuffix(name, ".nomad")
+	return name
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	var res = map[string]string{}
+	for k, v := range env {
+		res[k] = v
+	}
+	return res
+}
+
+// readEnvFile reads an environment file and returns the base environment
+// overridden with its variables. The file is first templated using the [[ and
+// ]] delimiters, with the env function returning variables from the base
+// environment or the process environment.
+func readEnvFile(fname string, base map[string]string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var env = copyEnv(base)
+
+	tmpl, err := template.New(path.Base(fname)).
+		Delims(DefaultLeftDelim, DefaultRightDelim).
+		Funcs(template.FuncMap{
+			"env": func(name string) string {
+				if val, ok := env[name]; ok {
+					return val
+				}
+				return os.Getenv(name)
+			},
+		}).
+		Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %v, %v", fname, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to template %v, %v", fname, err)
+	}
+
+	err = parseVars(fname, &buf, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// parseVars parses NAME=VALUE lines in vars. Empty lines and lines starting
+// with # are ignored, values can be enclosed in quotes.
+func parseVars(fname string, r io.Reader, vars map[string]string) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		vals := strings.SplitN(line, "=", 2)
+		if len(vals) != 2 {
+			return fmt.Errorf("Failed to parse %v line %d, expected NAME=VALUE", fname, n)
+		}
+		name := strings.TrimSpace(vals[0])
+		val := strings.TrimSpace(vals[1])
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		vars[name] = val
+	}
+
+	return scanner.Err()
+}
+
+// readEnvFileIfExists is like readEnvFile but returns the base environment
+// if the file does not exist.
+func readEnvFileIfExists(fname string, base map[string]string) (map[string]string, bool, error) {
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return base, false, nil
+	}
+	env, err := readEnvFile(fname, base)
+	return env, true, err
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v2"
+)
+
+// fixtures are the Consul and Vault data used to render templates offline
+type fixtures struct {
+	Env      map[string]interface{}            `json:"env"`
+	KV       map[string]interface{}            `json:"kv"`
+	Services map[string][]*fixtureService      `json:"services"`
+	Secrets  map[string]map[string]interface{} `json:"secrets"`
+}
+
+// fixtureService is an instance of a Consul service
+type fixtureService struct {
+	ID      string            `json:"id"`
+	Node    string            `json:"node"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta"`
+	Status  string            `json:"status"` // passing (default), warning or critical
+}
+
+// jsonValue converts a value decoded from YAML to a value that can be
+// encoded in JSON, with string keys in maps
+func jsonValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		var res = map[string]interface{}{}
+		for k, item := range v {
+			res[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return res
+	case []interface{}:
+		var res []interface{}
+		for _, item := range v {
+			res = append(res, jsonValue(item))
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+// readFixtures reads a JSON or YAML fixtures file
+func readFixtures(fname string) (*fixtures, error) {
+	var f = &fixtures{}
+	if fname == "" {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %v, %v", fname, err)
+	}
+
+	data, err = json.Marshal(jsonValue(raw))
+	if err == nil {
+		err = json.Unmarshal(data, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %v, %v", fname, err)
+	}
+
+	for name, instances := range f.Services {
+		for i, s := range instances {
+			if s.ID == "" {
+				s.ID = fmt.Sprintf("%s-%d", name, i)
+			}
+			if s.Node == "" {
+				s.Node = "node"
+			}
+			if s.Address == "" {
+				s.Address = "127.0.0.1"
+			}
+			if s.Status == "" {
+				s.Status = consulapi.HealthPassing
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// env returns the fixture environment variables
+func (f *fixtures) env() (map[string]string, error) {
+	var env = map[string]string{}
+	for k, v := range f.Env {
+		s, ok := configValue(v)
+		if !ok {
+			return nil, fmt.Errorf("Invalid value for environment variable %v in fixtures", k)
+		}
+		env[k] = s
+	}
+	return env, nil
+}
+
+// kv returns the fixture Consul keys sorted by key
+func (f *fixtures) kv() ([]*consulapi.KVPair, error) {
+	var pairs []*consulapi.KVPair
+	for k, v := range f.KV {
+		s, ok := configValue(v)
+		if !ok {
+			return nil, fmt.Errorf("Invalid value for key %v in fixtures", k)
+		}
+		pairs = append(pairs, &consulapi.KVPair{Key: k, Value: []byte(s), CreateIndex: 1, ModifyIndex: 1})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	return pairs, nil
+}
+
+// hasTag returns true if the service has the tag, or if the tag is empty
+func (s *fixtureService) hasTag(tag string) bool {
+	if tag == "" {
+		return true
+	}
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConsul writes a Consul API response. Blocking queries with an index
+// block until the client goes away, as the fixtures never change
+func writeConsul(w http.ResponseWriter, r *http.Request, status int, res interface{}) {
+	if index := r.URL.Query().Get("index"); index != "" && index != "0" {
+		<-r.Context().Done()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", "1")
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.WriteHeader(status)
+	if res != nil {
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// consulHandler serves the Consul API endpoints used by templates from the
+// fixtures
+func (f *fixtures) consulHandler(l hclog.Logger) (http.Handler, error) {
+	pairs, err := f.kv()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		q := r.URL.Query()
+		var res []*consulapi.KVPair
+		var keys []string
+		for _, pair := range pairs {
+			if pair.Key == key || ((q["recurse"] != nil || q["keys"] != nil) && strings.HasPrefix(pair.Key, key)) {
+				res = append(res, pair)
+				keys = append(keys, pair.Key)
+			}
+		}
+		if len(res) == 0 {
+			writeConsul(w, r, http.StatusNotFound, nil)
+		} else if q["keys"] != nil {
+			writeConsul(w, r, http.StatusOK, keys)
+		} else {
+			writeConsul(w, r, http.StatusOK, res)
+		}
+	})
+	mux.HandleFunc("/v1/health/service/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		q := r.URL.Query()
+		var res = []*consulapi.ServiceEntry{}
+		for _, s := range f.Services[name] {
+			if !s.hasTag(q.Get("tag")) || (q["passing"] != nil && s.Status != consulapi.HealthPassing) {
+				continue
+			}
+			res = append(res, &consulapi.ServiceEntry{
+				Node: &consulapi.Node{Node: s.Node, Address: s.Address, Datacenter: "dc1"},
+				Service: &consulapi.AgentService{
+					ID:      s.ID,
+					Service: name,
+					Tags:    s.Tags,
+					Meta:    s.Meta,
+					Port:    s.Port,
+					Address: s.Address,
+				},
+				Checks: consulapi.HealthChecks{{
+					Node:        s.Node,
+					CheckID:     "service:" + s.ID,
+					Name:        "fixture",
+					Status:      s.Status,
+					ServiceID:   s.ID,
+					ServiceName: name,
+				}},
+			})
+		}
+		writeConsul(w, r, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/catalog/service/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+		var res = []*consulapi.CatalogService{}
+		for _, s := range f.Services[name] {
+			if !s.hasTag(r.URL.Query().Get("tag")) {
+				continue
+			}
+			res = append(res, &consulapi.CatalogService{
+				ID:             s.Node,
+				Node:           s.Node,
+				Address:        s.Address,
+				Datacenter:     "dc1",
+				ServiceID:      s.ID,
+				ServiceName:    name,
+				ServiceAddress: s.Address,
+				ServiceTags:    s.Tags,
+				ServiceMeta:    s.Meta,
+				ServicePort:    s.Port,
+			})
+		}
+		writeConsul(w, r, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/catalog/services", func(w http.ResponseWriter, r *http.Request) {
+		var res = map[string][]string{}
+		for _, name := range names {
+			var tags = []string{}
+			for _, s := range f.Services[name] {
+				tags = append(tags, s.Tags...)
+			}
+			res[name] = tags
+		}
+		writeConsul(w, r, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/catalog/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var res = []*consulapi.Node{}
+		var seen = map[string]bool{}
+		for _, name := range names {
+			for _, s := range f.Services[name] {
+				if !seen[s.Node] {
+					seen[s.Node] = true
+					res = append(res, &consulapi.Node{Node: s.Node, Address: s.Address, Datacenter: "dc1"})
+				}
+			}
+		}
+		writeConsul(w, r, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/catalog/datacenters", func(w http.ResponseWriter, r *http.Request) {
+		writeConsul(w, r, http.StatusOK, []string{"dc1"})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		l.Warn("Consul endpoint not available in fixtures", "path", r.URL.Path)
+		writeConsul(w, r, http.StatusNotFound, nil)
+	})
+
+	return mux, nil
+}
+
+// vaultHandler serves the Vault secrets from the fixtures
+func (f *fixtures) vaultHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := f.Secrets[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok || r.Method != "GET" {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_duration": 0,
+			"renewable":      false,
+			"data":           secret,
+		})
+	})
+}
+
+// serveLocal serves the handler on a random local port until the returned
+// function is called, and returns the listen address
+func serveLocal(h http.Handler) (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(listener)
+	return listener.Addr().String(), func() { srv.Close() }, nil
+}
+
+// serve serves the fixtures with fake Consul and Vault servers and returns
+// the consul-template configuration to use them, and a function to stop
+// the servers
+func (f *fixtures) serve(l hclog.Logger) (*config.ConsulConfig, *config.VaultConfig, func(), error) {
+	h, err := f.consulHandler(l)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	consulAddr, stopConsul, err := serveLocal(h)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	vaultAddr, stopVault, err := serveLocal(f.vaultHandler())
+	if err != nil {
+		stopConsul()
+		return nil, nil, nil, err
+	}
+
+	var consul = config.DefaultConsulConfig()
+	consul.Address = config.String(consulAddr)
+	consul.Token = config.String("")
+	consul.SSL.Enabled = config.Bool(false)
+
+	var vault = config.DefaultVaultConfig()
+	vault.Address = config.String("http://" + vaultAddr)
+	vault.Token = config.String("fixtures")
+	vault.RenewToken = config.Bool(false)
+	vault.SSL.Enabled = config.Bool(false)
+
+	return consul, vault, func() {
+		stopConsul()
+		stopVault()
+	}, nil
+}
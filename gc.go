@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+)
+
+// listJobs returns all jobs registered in Nomad that belong to this
+// nomadspace, that is jobs with the namespace prefix (or in the Nomad
+// namespace) and the "ns" metadata set to the nomadspace id.
+func (ns *NomadSpace) listJobs(includeStopped bool) ([]*api.Job, error) {
+	q := ns.queryOptions()
+	if !ns.NomadNamespace {
+		q.Prefix = ns.Id + "-"
+	}
+	stubs, _, err := ns.nomadClient.Jobs().List(q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs of nomadspace %v, %v", ns.Id, err)
+	}
+
+	var jobs []*api.Job
+	for _, stub := range stubs {
+		if stub.Stop && !includeStopped {
+			continue
+		}
+		job, _, err := ns.nomadClient.Jobs().Info(stub.ID, ns.queryOptions())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get job %v, %v", stub.ID, err)
+		}
+		if job.Meta["ns"] != ns.Id {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// keepJob returns true if the job id matches the GC keep list. Patterns are
+// matched against both the full job id and the job id without the namespace
+// prefix.
+func (ns *NomadSpace) keepJob(id string) bool {
+	short := strings.TrimPrefix(id, ns.Id+"-")
+	for _, pattern := range ns.GCKeep {
+		if pattern == "" {
+			continue
+		}
+		for _, name := range []string{id, short} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAllJobs returns true if every given source file name has been
+// successfully submitted at least once.
+func (ns *NomadSpace) hasAllJobs(fnames []string) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, fname := range fnames {
+		if _, ok := ns.jobs[fname]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// gc deregisters jobs belonging to the nomadspace that no longer correspond
+// to any file in the input directory.
+func (ns *NomadSpace) gc(l hclog.Logger) error {
+	ns.mu.Lock()
+	var expected = map[string]bool{}
+	for _, id := range ns.jobs {
+		expected[id] = true
+	}
+	ns.mu.Unlock()
+
+	// Jobs of broken files are kept until the files are fixed
+	failed := ns.failedSources()
+
+	jobs, err := ns.listJobs(ns.GCPurge)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		id := *job.ID
+		if expected[id] {
+			continue
+		} else if failed[job.Meta["ns.source"]] {
+			l.Info("GC: keep job of a file in error", "job", id, "file", job.Meta["ns.source"])
+			continue
+		} else if ns.keepJob(id) {
+			l.Info("GC: keep orphan job", "job", id)
+			continue
+		} else if ns.GCDryRun {
+			l.Info("GC: would deregister orphan job (dry-run)", "job", id)
+			continue
+		}
+
+		evalID, _, e := ns.nomadClient.Jobs().Deregister(id, ns.GCPurge, ns.writeOptions())
+		if e != nil {
+			l.Error("GC: failed to deregister orphan job", "job", id, "error", e)
+			err = multierror.Append(err, fmt.Errorf("failed to deregister %v, %v", id, e)).ErrorOrNil()
+			continue
+		}
+		l.Info("GC: deregistered orphan job", "job", id, "purge", ns.GCPurge, "eval", evalID)
+	}
+
+	return err
+}
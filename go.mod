@@ -3,10 +3,16 @@ module github.com/mildred/nomadspace
 go 1.12
 
 require (
-	github.com/gorilla/websocket v1.4.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/hashicorp/consul-template v0.21.0
-	github.com/hashicorp/go-multierror v1.0.0
-	github.com/hashicorp/nomad/api v0.0.0-20190828185444-d4553b75694f
+	github.com/hashicorp/consul/api v1.1.0
+	github.com/hashicorp/go-hclog v0.9.2
+	github.com/hashicorp/go-multierror v1.1.1
+	github.com/hashicorp/hcl v1.0.0
+	github.com/hashicorp/nomad/api v0.0.0-20240717122358-3d93bd3778f3
+	github.com/hashicorp/vault/api v1.0.5-0.20190730042357-746c0b111519
 	github.com/martinlindhe/base36 v1.0.0
 	github.com/miekg/dns v1.1.15
+	github.com/prometheus/client_golang v1.1.0
+	gopkg.in/yaml.v2 v2.2.2
 )
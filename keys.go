@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+)
+
+// keysPrefix returns the Consul KV prefix where keys from .keys files are
+// written
+func (ns *NomadSpace) keysPrefix() string {
+	return strings.Replace(ns.KeysPrefix, "${NS}", ns.Id, -1)
+}
+
+// readKeys reads a .keys file
+func readKeys(fname string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(fname, data)
+}
+
+// parseKeys parses the content of a .keys file, containing KEY=VALUE lines
+func parseKeys(fname string, content []byte) (map[string]string, error) {
+	var keys = map[string]string{}
+	err := parseVars(fname, bytes.NewReader(content), keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// writeKeys writes the keys in Consul KV under the nomadspace prefix. Unless
+// KeysOverwrite is set, existing keys are left untouched.
+func (ns *NomadSpace) writeKeys(l hclog.Logger, fname string, keys map[string]string) error {
+	var err error
+	var names []string
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var written = true
+		var e error
+		pair := &consulapi.KVPair{
+			Key:   ns.keysPrefix() + strings.TrimPrefix(name, "/"),
+			Value: []byte(keys[name]),
+		}
+		if ns.KeysOverwrite {
+			_, e = ns.consulClient.KV().Put(pair, nil)
+		} else {
+			// ModifyIndex 0 only writes the key if it does not exist
+			written, _, e = ns.consulClient.KV().CAS(pair, nil)
+		}
+		if e != nil {
+			l.Error("Failed to write key", "file", fname, "key", pair.Key, "error", e)
+			err = multierror.Append(err, fmt.Errorf("failed to write key %v from %v, %v", pair.Key, fname, e)).ErrorOrNil()
+			continue
+		}
+
+		if written {
+			// Only keys written by the nomadspace are deleted on teardown
+			ns.mu.Lock()
+			ns.keys[pair.Key] = true
+			ns.mu.Unlock()
+			l.Info("Wrote key", "file", fname, "key", pair.Key)
+		} else {
+			l.Info("Key already exists", "file", fname, "key", pair.Key)
+		}
+	}
+
+	return err
+}
+
+// deleteKeys deletes the keys written from .keys files
+func (ns *NomadSpace) deleteKeys(l hclog.Logger) error {
+	var err error
+	var keys []string
+
+	ns.mu.Lock()
+	for key := range ns.keys {
+		keys = append(keys, key)
+	}
+	ns.mu.Unlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		_, e := ns.consulClient.KV().Delete(key, nil)
+		if e != nil {
+			l.Error("Failed to delete key", "key", key, "error", e)
+			err = multierror.Append(err, fmt.Errorf("failed to delete key %v, %v", key, e)).ErrorOrNil()
+			continue
+		}
+		l.Info("Deleted key", "key", key)
+		ns.mu.Lock()
+		delete(ns.keys, key)
+		ns.mu.Unlock()
+	}
+
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+)
+
+// maxServiceName is the maximum length of a Consul service name, as a DNS
+// label
+const maxServiceName = 63
+
+// lintJob checks a job after namespaceJob and returns its problems
+func lintJob(job *api.Job) []string {
+	var problems []string
+
+	if len(job.Datacenters) == 0 {
+		problems = append(problems, fmt.Sprintf("job %v has no datacenters", *job.ID))
+	}
+
+	var checkServices = func(services []*api.Service) {
+		for _, service := range services {
+			if len(service.Name) > maxServiceName {
+				problems = append(problems, fmt.Sprintf("service %v of job %v is longer than %d characters", service.Name, *job.ID, maxServiceName))
+			}
+		}
+	}
+
+	var dnsKeys = map[string]bool{}
+	for _, keys := range dnsConfigKeys {
+		dnsKeys[keys[0]] = true
+		dnsKeys[keys[1]] = true
+	}
+
+	for _, group := range job.TaskGroups {
+		checkServices(group.Services)
+		bridge := isBridgeNetwork(group)
+		for _, task := range group.Tasks {
+			checkServices(task.Services)
+			keys, ok := dnsConfigKeys[task.Driver]
+			for key := range task.Config {
+				if !dnsKeys[key] {
+					continue
+				} else if !ok || (key != keys[0] && key != keys[1]) {
+					problems = append(problems, fmt.Sprintf("task %v of job %v sets %v, ignored by the %v driver", task.Name, *job.ID, key, task.Driver))
+				} else if bridge {
+					problems = append(problems, fmt.Sprintf("task %v of job %v sets %v, ignored in a bridge network", task.Name, *job.ID, key))
+				}
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// validateJob validates the job with the Nomad agent and returns its
+// problems
+func (ns *NomadSpace) validateJob(job *api.Job) ([]string, error) {
+	res, _, err := ns.nomadClient.Jobs().Validate(job, ns.writeOptions())
+	if err != nil {
+		return nil, err
+	}
+	var problems = res.ValidationErrors
+	if res.Error != "" && len(problems) == 0 {
+		problems = append(problems, res.Error)
+	}
+	return problems, nil
+}
+
+// lint reads the input directory like exec, renders the templates once,
+// namespaces the jobs and checks them. Jobs are validated by the Nomad agent
+// unless offline, .nomad files being skipped when offline. Skipped files are
+// problems unless allowOffline is set. Child nomadspaces are linted too. It
+// returns the problems found prefixed with the file they are found in.
+func (ns *NomadSpace) lint(ctx context.Context, l hclog.Logger, inputDir string, timeout time.Duration, allowOffline bool) ([]string, error) {
+	var problems []string
+	var report = func(fname string, msg string) {
+		problems = append(problems, fmt.Sprintf("%v: %v", path.Join(inputDir, fname), msg))
+	}
+	var skip = func(fname string) {
+		if allowOffline {
+			l.Warn("Skip .nomad file, .nomad files are parsed by the Nomad agent", "file", path.Join(inputDir, fname))
+		} else {
+			report(fname, "not checked, .nomad files are parsed by the Nomad agent which is unreachable")
+		}
+	}
+
+	in, err := ns.readInputDir(l, inputDir)
+	if in == nil {
+		return nil, err
+	} else if err != nil {
+		for _, e := range err.(*multierror.Error).Errors {
+			problems = append(problems, e.Error())
+		}
+	}
+	for _, fname := range in.skipped {
+		skip(fname)
+	}
+
+	var dirs []string
+	for dir := range in.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var jobs = in.jobs
+	var jobEnvs = in.jobEnvs
+	rendered, res := ns.renderInput(ctx, l, in, timeout)
+	problems = append(problems, res...)
+
+	var names []string
+	for fname := range rendered {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+
+	for _, fname := range names {
+		r := rendered[fname]
+		if r.contents == nil {
+			report(fname, fmt.Sprintf("not rendered, missing dependencies: %v", strings.Join(r.missingDeps, ", ")))
+			continue
+		} else if strings.HasSuffix(fname, ".keys.tmpl") {
+			if _, err := parseKeys(fname, r.contents); err != nil {
+				problems = append(problems, err.Error())
+			}
+			continue
+		} else if !strings.HasSuffix(fname, ".json.tmpl") && !strings.HasSuffix(fname, ".nomad.tmpl") {
+			continue
+		} else if strings.HasSuffix(fname, ".nomad.tmpl") && ns.offline {
+			skip(fname)
+			continue
+		}
+		job, err := ns.parseRendered(fname, r.contents)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		jobs[fname] = job
+		jobEnvs[fname] = r.env
+	}
+
+	var fnames []string
+	for fname := range jobs {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+
+	if _, err := sortJobs(jobs); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	var ids = map[string]string{}
+	for _, fname := range fnames {
+		job := jobs[fname]
+		if job.ID == nil || *job.ID == "" {
+			report(fname, "job has no id")
+			continue
+		}
+		ns.namespaceJob(job, fname, jobEnvs[fname])
+		if other, ok := ids[*job.ID]; ok {
+			report(fname, fmt.Sprintf("job id %v already used in %v", *job.ID, other))
+		}
+		ids[*job.ID] = fname
+
+		for _, p := range lintJob(job) {
+			report(fname, p)
+		}
+
+		if !ns.offline {
+			res, err := ns.validateJob(job)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range res {
+				report(fname, p)
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		child := newChild(ns, dir, in.dirs[dir])
+		err := os.MkdirAll(child.RenderedDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		res, err := child.lint(ctx, l, path.Join(inputDir, dir), timeout, allowOffline)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, res...)
+	}
+
+	return problems, nil
+}
+
+// runLint lints the input directory and prints the problems found. It fails
+// if there are problems, for use in CI. When the Nomad agent is unreachable,
+// the .nomad files that cannot be checked are problems unless allowOffline is
+// set.
+func (ns *NomadSpace) runLint(ctx context.Context, l hclog.Logger, inputDir, addr string, timeout time.Duration, allowOffline bool) error {
+	_, err := ns.nomadClient.Status().Leader()
+	ns.offline = err != nil
+	if ns.offline {
+		l.Warn("Nomad agent unreachable, .nomad files are skipped and jobs are only checked locally", "address", addr, "error", err)
+	}
+
+	problems, err := ns.lint(ctx, l, inputDir, timeout, allowOffline)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %v", len(problems), inputDir)
+	}
+
+	l.Info("No problem found", "dir", inputDir)
+	return nil
+}
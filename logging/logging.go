@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Components logging with their own name and level
+const (
+	Exec     = "exec"
+	Template = "template"
+	Nsdns    = "nsdns"
+	Dnsmasq  = "dnsmasq"
+)
+
+var Components = []string{Exec, Template, Nsdns, Dnsmasq}
+
+// Off is the level disabling the logs of a component
+const Off = "off"
+
+type Options struct {
+	Level  string            // Default level
+	Levels map[string]string // Level per component
+	JSON   bool
+	Output io.Writer
+}
+
+// Loggers holds a logger for each component, all writing to the same output
+type Loggers struct {
+	loggers map[string]hclog.Logger
+}
+
+func validLevel(level string) bool {
+	return level == Off || hclog.LevelFromString(level) != hclog.NoLevel
+}
+
+// ParseLevels parses component levels in the form
+// "component=level,component=level"
+func ParseLevels(s string) (map[string]string, error) {
+	var levels = map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid component level %q, expected component=level", item)
+		}
+		levels[strings.TrimSpace(kv[0])] = strings.ToLower(strings.TrimSpace(kv[1]))
+	}
+	return levels, nil
+}
+
+func New(opts *Options) (*Loggers, error) {
+	var output = opts.Output
+	if output == nil {
+		output = os.Stderr
+	}
+
+	if !validLevel(opts.Level) {
+		return nil, fmt.Errorf("Invalid log level %q, expected trace, debug, info, warn, error or off", opts.Level)
+	}
+
+	var components = map[string]bool{}
+	for _, c := range Components {
+		components[c] = true
+	}
+	var names []string
+	for c, level := range opts.Levels {
+		if !components[c] {
+			names = append(names, c)
+		} else if !validLevel(level) {
+			return nil, fmt.Errorf("Invalid log level %q for %v, expected trace, debug, info, warn, error or off", level, c)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return nil, fmt.Errorf("Invalid log component %v, expected one of %v", strings.Join(names, ", "), strings.Join(Components, ", "))
+	}
+
+	var mutex sync.Mutex
+	var ls = &Loggers{loggers: map[string]hclog.Logger{}}
+	for _, c := range Components {
+		level, ok := opts.Levels[c]
+		if !ok {
+			level = opts.Level
+		}
+		if level == Off {
+			ls.loggers[c] = hclog.NewNullLogger()
+			continue
+		}
+		ls.loggers[c] = hclog.New(&hclog.LoggerOptions{
+			Name:       c,
+			Level:      hclog.LevelFromString(level),
+			Output:     output,
+			Mutex:      &mutex,
+			JSONFormat: opts.JSON,
+		})
+	}
+
+	return ls, nil
+}
+
+// Logger returns the hclog logger of a component
+func (ls *Loggers) Logger(component string) hclog.Logger {
+	return ls.loggers[component]
+}
+
+// Writer returns a writer that logs each write to the component logger with
+// the level of its prefix
+func (ls *Loggers) Writer(component string) io.Writer {
+	return &writer{ls.loggers[component]}
+}
+
+// StdLogger returns a standard logger that logs to the component logger with
+// the level prefix of each message
+func (ls *Loggers) StdLogger(component string) *log.Logger {
+	return log.New(ls.Writer(component), "", 0)
+}
+
+type writer struct {
+	l hclog.Logger
+}
+
+// pickLevel returns the level of a log message and the message without its
+// level. Levels are given as a prefix in square brackets ("[DEBUG]",
+// "[ERR]") by consul-template, nsdns and dnsmasq, other messages are logged
+// at the info level.
+func pickLevel(msg string) (hclog.Level, string) {
+	for _, prefix := range []struct {
+		prefix string
+		level  hclog.Level
+	}{
+		{"[TRACE]", hclog.Trace},
+		{"[DEBUG]", hclog.Debug},
+		{"[INFO]", hclog.Info},
+		{"[WARN]", hclog.Warn},
+		{"[ERR]", hclog.Error},
+		{"[ERROR]", hclog.Error},
+	} {
+		if strings.HasPrefix(msg, prefix.prefix) {
+			return prefix.level, strings.TrimSpace(msg[len(prefix.prefix):])
+		}
+	}
+	return hclog.Info, msg
+}
+
+func logAt(l hclog.Logger, level hclog.Level, msg string) {
+	switch level {
+	case hclog.Trace:
+		l.Trace(msg)
+	case hclog.Debug:
+		l.Debug(msg)
+	case hclog.Warn:
+		l.Warn(msg)
+	case hclog.Error:
+		l.Error(msg)
+	default:
+		l.Info(msg)
+	}
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	msg := strings.TrimRight(string(data), " \t\n")
+	if msg != "" {
+		level, msg := pickLevel(msg)
+		logAt(w.l, level, msg)
+	}
+	return len(data), nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,18 +13,23 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/consul-template/manager"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/api"
 	"github.com/mildred/nomadspace/dns"
 	"github.com/mildred/nomadspace/dnsmasq"
+	"github.com/mildred/nomadspace/logging"
 	"github.com/mildred/nomadspace/ns"
 	"github.com/mildred/nomadspace/waitgroup"
 )
@@ -49,25 +56,71 @@ func stringEnv(name, defVal string) string {
 	return val
 }
 
-func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
-	go func() {
-		s := <-sig
-		log.Printf("Received %v, terminating...", s)
-		cancel()
-		signal.Stop(sig)
-	}()
+func durationEnv(name string, defVal time.Duration) time.Duration {
+	val := os.Getenv(name)
+	res, err := time.ParseDuration(val)
+	if err != nil || val == "" {
+		res = defVal
+	}
+	return res
+}
+
+func intEnv(name string, defVal int) int {
+	val := os.Getenv(name)
+	res, err := strconv.Atoi(val)
+	if err != nil || val == "" {
+		res = defVal
+	}
+	return res
+}
+
+// logger is the exec logger once logging is set up
+var logger = hclog.New(&hclog.LoggerOptions{Name: logging.Exec})
+
+// commands are the nomadspace commands, run being the default
+var commands = []string{"run", "config dump", "lint", "render", "id", "list", "tree", "status", "destroy"}
+
+// commandArgs are the maximum numbers of arguments of the commands, id
+// accepting any number of job names
+var commandArgs = map[string]int{
+	"run":         0,
+	"config dump": 0,
+	"lint":        1,
+	"render":      1,
+	"list":        0,
+	"tree":        0,
+	"status":      1,
+	"destroy":     1,
+}
 
-	err := run(ctx)
+// parseCommand returns the command and its arguments from the command line
+func parseCommand(args []string) (string, []string, error) {
+	for _, command := range commands {
+		words := strings.Fields(command)
+		if len(args) >= len(words) && reflect.DeepEqual(args[:len(words)], words) {
+			return command, args[len(words):], nil
+		}
+	}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return "", nil, fmt.Errorf("Unknown command %q, expected one of: %v", strings.Join(args, " "), strings.Join(commands, ", "))
+	}
+	return "run", args, nil
+}
+
+func main() {
+	command, args, err := parseCommand(os.Args[1:])
+	if err == nil {
+		err = run(context.Background(), command, args)
+	}
 	if err != nil {
-		log.Fatalf("ERROR: %v", err)
+		logger.Error("NomadSpace failed", "error", err)
+		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, command string, args []string) error {
 	var err error
+	var configFile string
 	var inputDir string
 	var jobName string
 	var printRendered bool
@@ -81,22 +134,240 @@ func run(ctx context.Context) error {
 	var dnsmasqArgs dnsmasq.Args
 	var dnsmasqEnable bool
 	var logCT bool
-
+	var gcEnable bool
+	var gcDryRun bool
+	var gcPurge bool
+	var gcKeep string
+	var teardown bool
+	var teardownTimeout time.Duration
+	var plan bool
+	var planDenyDestructive bool
+	var watch bool
+	var injectEnv bool
+	var keysPrefix string
+	var keysOverwrite bool
+	var namespaceMode string
+	var prefixServices bool
+	var wait bool
+	var waitTimeout time.Duration
+	var dependsWait string
+	var watchDelay time.Duration
+	var httpListen string
+	var logLevel string
+	var logLevels string
+	var logJSON bool
+	var dnsmasqExtraFlags string
+	var nomadOpts nomadOptions
+	var consulOpts consulOptions
+	var vaultOpts vaultOptions
+	var templateWaitMin time.Duration
+	var templateWaitMax time.Duration
+	var templateRetryAttempts int
+	var templateRetryBackoff time.Duration
+	var templateRetryMaxBackoff time.Duration
+	var partial bool
+	var submitRetryAttempts int
+	var submitRetryBackoff time.Duration
+	var submitRetryMaxBackoff time.Duration
+	var renderTimeout time.Duration
+	var renderFixtures string
+	var renderOutputDir string
+	var allowOffline bool
+	var purge bool
+	var parentId string
+
+	flag.StringVar(&configFile,
+		"config", stringEnv("NOMADSPACE_CONFIG", ""),
+		"HCL or JSON configuration file, defaults to nomadspace.hcl in the input directory if it exists [NOMADSPACE_CONFIG]")
 	flag.StringVar(&inputDir,
 		"input-dir", os.Getenv("NOMADSPACE_INPUT_DIR"),
 		"Input directory where to find Nomad jobs [NOMADSPACE_INPUT_DIR]")
 	flag.StringVar(&jobName,
 		"job-name", os.Getenv("NOMAD_JOB_NAME"),
 		"Job name to infer NomadSpace ID [NOMAD_JOB_NAME]")
+	flag.StringVar(&parentId,
+		"parent", os.Getenv("NOMADSPACE_ID"),
+		"Id of the nomadspace the job runs in, set in its environment by the parent nomadspace [NOMADSPACE_ID]")
 	flag.BoolVar(&printRendered,
 		"print-rendered", boolEnv("NOMADSPACE_PRINT_RENDERED", false),
 		"Print rendered templates [NOMADSPACE_PRINT_RENDERED]")
+	flag.BoolVar(&teardown,
+		"teardown", boolEnv("NOMADSPACE_TEARDOWN", false),
+		"Deregister all submitted jobs when terminating [NOMADSPACE_TEARDOWN]")
+	flag.DurationVar(&teardownTimeout,
+		"teardown-timeout", durationEnv("NOMADSPACE_TEARDOWN_TIMEOUT", 30*time.Second),
+		"Maximum duration to wait for the evaluations of deregistered jobs on teardown or destroy [NOMADSPACE_TEARDOWN_TIMEOUT]")
+	flag.BoolVar(&plan,
+		"plan", boolEnv("NOMADSPACE_PLAN", false),
+		"Print the plan of each job before submitting it [NOMADSPACE_PLAN]")
+	flag.BoolVar(&planDenyDestructive,
+		"plan-deny-destructive", boolEnv("NOMADSPACE_PLAN_DENY_DESTRUCTIVE", false),
+		"Refuse to submit jobs whose plan destroys allocations, implies --plan [NOMADSPACE_PLAN_DENY_DESTRUCTIVE]")
+	flag.BoolVar(&watch,
+		"watch", boolEnv("NOMADSPACE_WATCH", false),
+		"Watch the input directory and apply changes [NOMADSPACE_WATCH]")
+	flag.DurationVar(&watchDelay,
+		"watch-delay", durationEnv("NOMADSPACE_WATCH_DELAY", 2*time.Second),
+		"Delay without changes before applying them [NOMADSPACE_WATCH_DELAY]")
+	flag.BoolVar(&injectEnv,
+		"inject-env", boolEnv("NOMADSPACE_INJECT_ENV", false),
+		"Inject variables from environment files in every task [NOMADSPACE_INJECT_ENV]")
+	flag.StringVar(&namespaceMode,
+		"namespace-mode", stringEnv("NOMADSPACE_NAMESPACE_MODE", "prefix"),
+		"How to isolate jobs: prefix job names or use a Nomad namespace (prefix, nomad) [NOMADSPACE_NAMESPACE_MODE]")
+	flag.BoolVar(&prefixServices,
+		"prefix-services", boolEnv("NOMADSPACE_PREFIX_SERVICES", true),
+		"Prefix Consul service names with the namespace [NOMADSPACE_PREFIX_SERVICES]")
+	flag.StringVar(&nomadOpts.Addr,
+		"nomad-addr", stringEnv("NOMADSPACE_NOMAD_ADDR", stringEnv("NOMAD_ADDR", "")),
+		"Nomad agent address [NOMADSPACE_NOMAD_ADDR, NOMAD_ADDR]")
+	flag.StringVar(&nomadOpts.Token,
+		"nomad-token", stringEnv("NOMADSPACE_NOMAD_TOKEN", stringEnv("NOMAD_TOKEN", "")),
+		"Nomad ACL token [NOMADSPACE_NOMAD_TOKEN, NOMAD_TOKEN]")
+	flag.StringVar(&nomadOpts.TokenFile,
+		"nomad-token-file", stringEnv("NOMADSPACE_NOMAD_TOKEN_FILE", ""),
+		"File containing the Nomad ACL token [NOMADSPACE_NOMAD_TOKEN_FILE]")
+	flag.StringVar(&nomadOpts.TokenVaultPath,
+		"nomad-token-vault-path", stringEnv("NOMADSPACE_NOMAD_TOKEN_VAULT_PATH", ""),
+		"Vault path of the Nomad secrets engine role to get the Nomad ACL token from, for example nomad/creds/deploy [NOMADSPACE_NOMAD_TOKEN_VAULT_PATH]")
+	flag.StringVar(&nomadOpts.CACert,
+		"nomad-cacert", stringEnv("NOMADSPACE_NOMAD_CACERT", stringEnv("NOMAD_CACERT", "")),
+		"CA certificate file to verify the Nomad agent certificate [NOMADSPACE_NOMAD_CACERT, NOMAD_CACERT]")
+	flag.StringVar(&nomadOpts.ClientCert,
+		"nomad-client-cert", stringEnv("NOMADSPACE_NOMAD_CLIENT_CERT", stringEnv("NOMAD_CLIENT_CERT", "")),
+		"Client certificate file for Nomad TLS authentication [NOMADSPACE_NOMAD_CLIENT_CERT, NOMAD_CLIENT_CERT]")
+	flag.StringVar(&nomadOpts.ClientKey,
+		"nomad-client-key", stringEnv("NOMADSPACE_NOMAD_CLIENT_KEY", stringEnv("NOMAD_CLIENT_KEY", "")),
+		"Client key file for Nomad TLS authentication [NOMADSPACE_NOMAD_CLIENT_KEY, NOMAD_CLIENT_KEY]")
+	flag.StringVar(&nomadOpts.Region,
+		"nomad-region", stringEnv("NOMADSPACE_NOMAD_REGION", stringEnv("NOMAD_REGION", "")),
+		"Nomad region [NOMADSPACE_NOMAD_REGION, NOMAD_REGION]")
+	flag.StringVar(&nomadOpts.Namespace,
+		"nomad-namespace", stringEnv("NOMADSPACE_NOMAD_NAMESPACE", stringEnv("NOMAD_NAMESPACE", "")),
+		"Nomad namespace for jobs, unless --namespace-mode=nomad [NOMADSPACE_NOMAD_NAMESPACE, NOMAD_NAMESPACE]")
+	flag.StringVar(&consulOpts.Addr,
+		"consul-addr", stringEnv("NOMADSPACE_CONSUL_ADDR", stringEnv("CONSUL_HTTP_ADDR", "")),
+		"Consul HTTP address [NOMADSPACE_CONSUL_ADDR, CONSUL_HTTP_ADDR]")
+	flag.StringVar(&consulOpts.Token,
+		"consul-token", stringEnv("NOMADSPACE_CONSUL_TOKEN", stringEnv("CONSUL_HTTP_TOKEN", "")),
+		"Consul ACL token [NOMADSPACE_CONSUL_TOKEN, CONSUL_HTTP_TOKEN]")
+	flag.StringVar(&consulOpts.CACert,
+		"consul-cacert", stringEnv("NOMADSPACE_CONSUL_CACERT", stringEnv("CONSUL_CACERT", "")),
+		"CA certificate file to verify the Consul agent certificate [NOMADSPACE_CONSUL_CACERT, CONSUL_CACERT]")
+	flag.StringVar(&consulOpts.ClientCert,
+		"consul-client-cert", stringEnv("NOMADSPACE_CONSUL_CLIENT_CERT", stringEnv("CONSUL_CLIENT_CERT", "")),
+		"Client certificate file for Consul TLS authentication [NOMADSPACE_CONSUL_CLIENT_CERT, CONSUL_CLIENT_CERT]")
+	flag.StringVar(&consulOpts.ClientKey,
+		"consul-client-key", stringEnv("NOMADSPACE_CONSUL_CLIENT_KEY", stringEnv("CONSUL_CLIENT_KEY", "")),
+		"Client key file for Consul TLS authentication [NOMADSPACE_CONSUL_CLIENT_KEY, CONSUL_CLIENT_KEY]")
+	flag.StringVar(&vaultOpts.Addr,
+		"vault-addr", stringEnv("NOMADSPACE_VAULT_ADDR", stringEnv("VAULT_ADDR", "")),
+		"Vault address, enables Vault in templates [NOMADSPACE_VAULT_ADDR, VAULT_ADDR]")
+	flag.StringVar(&vaultOpts.Token,
+		"vault-token", stringEnv("NOMADSPACE_VAULT_TOKEN", stringEnv("VAULT_TOKEN", "")),
+		"Vault token [NOMADSPACE_VAULT_TOKEN, VAULT_TOKEN]")
+	flag.StringVar(&vaultOpts.RoleID,
+		"vault-role-id", stringEnv("NOMADSPACE_VAULT_ROLE_ID", ""),
+		"Vault AppRole role id to login with instead of a token [NOMADSPACE_VAULT_ROLE_ID]")
+	flag.StringVar(&vaultOpts.SecretID,
+		"vault-secret-id", stringEnv("NOMADSPACE_VAULT_SECRET_ID", ""),
+		"Vault AppRole secret id [NOMADSPACE_VAULT_SECRET_ID]")
+	flag.StringVar(&vaultOpts.CACert,
+		"vault-cacert", stringEnv("NOMADSPACE_VAULT_CACERT", stringEnv("VAULT_CACERT", "")),
+		"CA certificate file to verify the Vault server certificate [NOMADSPACE_VAULT_CACERT, VAULT_CACERT]")
+	flag.StringVar(&vaultOpts.ClientCert,
+		"vault-client-cert", stringEnv("NOMADSPACE_VAULT_CLIENT_CERT", stringEnv("VAULT_CLIENT_CERT", "")),
+		"Client certificate file for Vault TLS authentication [NOMADSPACE_VAULT_CLIENT_CERT, VAULT_CLIENT_CERT]")
+	flag.StringVar(&vaultOpts.ClientKey,
+		"vault-client-key", stringEnv("NOMADSPACE_VAULT_CLIENT_KEY", stringEnv("VAULT_CLIENT_KEY", "")),
+		"Client key file for Vault TLS authentication [NOMADSPACE_VAULT_CLIENT_KEY, VAULT_CLIENT_KEY]")
+	flag.DurationVar(&templateWaitMin,
+		"template-wait-min", durationEnv("NOMADSPACE_TEMPLATE_WAIT_MIN", 0),
+		"Minimum quiescence time before rendering templates, disabled if zero [NOMADSPACE_TEMPLATE_WAIT_MIN]")
+	flag.DurationVar(&templateWaitMax,
+		"template-wait-max", durationEnv("NOMADSPACE_TEMPLATE_WAIT_MAX", 0),
+		"Maximum time to wait for quiescence before rendering templates, defaults to 4 times the minimum [NOMADSPACE_TEMPLATE_WAIT_MAX]")
+	flag.IntVar(&templateRetryAttempts,
+		"template-retry-attempts", intEnv("NOMADSPACE_TEMPLATE_RETRY_ATTEMPTS", 12),
+		"Retries of failed Consul and Vault queries in templates, unlimited if zero [NOMADSPACE_TEMPLATE_RETRY_ATTEMPTS]")
+	flag.DurationVar(&templateRetryBackoff,
+		"template-retry-backoff", durationEnv("NOMADSPACE_TEMPLATE_RETRY_BACKOFF", 250*time.Millisecond),
+		"Initial delay between retries, doubled after each retry [NOMADSPACE_TEMPLATE_RETRY_BACKOFF]")
+	flag.DurationVar(&templateRetryMaxBackoff,
+		"template-retry-max-backoff", durationEnv("NOMADSPACE_TEMPLATE_RETRY_MAX_BACKOFF", time.Minute),
+		"Maximum delay between retries [NOMADSPACE_TEMPLATE_RETRY_MAX_BACKOFF]")
+	flag.BoolVar(&partial,
+		"partial", boolEnv("NOMADSPACE_PARTIAL", false),
+		"Submit the valid jobs when some files fail to be read or submitted, and keep retrying the failed ones [NOMADSPACE_PARTIAL]")
+	flag.IntVar(&submitRetryAttempts,
+		"submit-retry-attempts", intEnv("NOMADSPACE_SUBMIT_RETRY_ATTEMPTS", 5),
+		"Retries of job submissions failing with transient Nomad API errors [NOMADSPACE_SUBMIT_RETRY_ATTEMPTS]")
+	flag.DurationVar(&submitRetryBackoff,
+		"submit-retry-backoff", durationEnv("NOMADSPACE_SUBMIT_RETRY_BACKOFF", time.Second),
+		"Initial delay between submission retries, doubled after each retry [NOMADSPACE_SUBMIT_RETRY_BACKOFF]")
+	flag.DurationVar(&submitRetryMaxBackoff,
+		"submit-retry-max-backoff", durationEnv("NOMADSPACE_SUBMIT_RETRY_MAX_BACKOFF", time.Minute),
+		"Maximum delay between submission retries [NOMADSPACE_SUBMIT_RETRY_MAX_BACKOFF]")
+	flag.DurationVar(&renderTimeout,
+		"render-timeout", durationEnv("NOMADSPACE_RENDER_TIMEOUT", 30*time.Second),
+		"Maximum duration to render templates once with the lint and render commands, templates missing dependencies are reported [NOMADSPACE_RENDER_TIMEOUT]")
+	flag.StringVar(&renderFixtures,
+		"render-fixtures", os.Getenv("NOMADSPACE_RENDER_FIXTURES"),
+		"JSON or YAML file with the Consul keys, services, Vault secrets and environment used by the render command [NOMADSPACE_RENDER_FIXTURES]")
+	flag.StringVar(&renderOutputDir,
+		"render-output-dir", stringEnv("NOMADSPACE_RENDER_OUTPUT_DIR", "rendered"),
+		"Directory where the render command writes the rendered templates [NOMADSPACE_RENDER_OUTPUT_DIR]")
+	flag.BoolVar(&allowOffline,
+		"allow-offline", boolEnv("NOMADSPACE_ALLOW_OFFLINE", false),
+		"Do not count the .nomad files the lint command skips when the Nomad agent is unreachable as problems [NOMADSPACE_ALLOW_OFFLINE]")
+	flag.BoolVar(&purge,
+		"purge", boolEnv("NOMADSPACE_PURGE", false),
+		"Purge the jobs deregistered by the destroy command [NOMADSPACE_PURGE]")
+	flag.StringVar(&keysPrefix,
+		"keys-prefix", stringEnv("NOMADSPACE_KEYS_PREFIX", "${NS}/"),
+		"Consul KV prefix for keys in .keys files, ${NS} replaced with namespace [NOMADSPACE_KEYS_PREFIX]")
+	flag.BoolVar(&keysOverwrite,
+		"keys-overwrite", boolEnv("NOMADSPACE_KEYS_OVERWRITE", false),
+		"Overwrite existing Consul keys from .keys files [NOMADSPACE_KEYS_OVERWRITE]")
+	flag.BoolVar(&wait,
+		"wait", boolEnv("NOMADSPACE_WAIT", false),
+		"Wait for submitted jobs to be deployed and report their state [NOMADSPACE_WAIT]")
+	flag.DurationVar(&waitTimeout,
+		"wait-timeout", durationEnv("NOMADSPACE_WAIT_TIMEOUT", 10*time.Minute),
+		"Maximum duration to wait for a job deployment [NOMADSPACE_WAIT_TIMEOUT]")
+	flag.StringVar(&dependsWait,
+		"depends-wait", stringEnv("NOMADSPACE_DEPENDS_WAIT", "none"),
+		"Before submitting a job, wait for its dependencies deployment or Consul services (none, deployment, consul) [NOMADSPACE_DEPENDS_WAIT]")
+	flag.StringVar(&httpListen,
+		"http-listen", stringEnv("NOMADSPACE_HTTP_LISTEN", ""),
+		"Listen address of the HTTP server for /healthz, /v1/status and /metrics, disabled if empty [NOMADSPACE_HTTP_LISTEN]")
+	flag.StringVar(&logLevel,
+		"log-level", stringEnv("NOMADSPACE_LOG_LEVEL", "info"),
+		"Log level (trace, debug, info, warn, error, off) [NOMADSPACE_LOG_LEVEL]")
+	flag.StringVar(&logLevels,
+		"log-levels", stringEnv("NOMADSPACE_LOG_LEVELS", ""),
+		"Comma separated log levels per component (exec, template, nsdns, dnsmasq), for example nsdns=debug,dnsmasq=warn [NOMADSPACE_LOG_LEVELS]")
+	flag.BoolVar(&logJSON,
+		"log-json", boolEnv("NOMADSPACE_LOG_JSON", false),
+		"Log in JSON format [NOMADSPACE_LOG_JSON]")
 	flag.BoolVar(&logCT,
 		"log-consul-template", boolEnv("NOMADSPACE_LOG_CONSUL_TEMPLATE", false),
-		"Print consul-template small logs [NOMADSPACE_LOG_CONSUL_TEMPLATE]")
+		"Print consul-template logs at the --log-level, otherwise only warnings and errors [NOMADSPACE_LOG_CONSUL_TEMPLATE]")
 	flag.BoolVar(&verboseCT,
 		"verbose-consul-template", boolEnv("NOMADSPACE_VERBOSE_CONSUL_TEMPLATE", false),
 		"Print consul-template logs [NOMADSPACE_VERBOSE_CONSUL_TEMPLATE]")
+	flag.BoolVar(&gcEnable,
+		"gc", boolEnv("NOMADSPACE_GC", false),
+		"Deregister jobs of the nomadspace no longer in the input dir [NOMADSPACE_GC]")
+	flag.BoolVar(&gcDryRun,
+		"gc-dry-run", boolEnv("NOMADSPACE_GC_DRY_RUN", false),
+		"Only log jobs that would be garbage collected [NOMADSPACE_GC_DRY_RUN]")
+	flag.BoolVar(&gcPurge,
+		"gc-purge", boolEnv("NOMADSPACE_GC_PURGE", false),
+		"Purge garbage collected jobs [NOMADSPACE_GC_PURGE]")
+	flag.StringVar(&gcKeep,
+		"gc-keep", stringEnv("NOMADSPACE_GC_KEEP", ""),
+		"Comma separated job names or patterns never garbage collected [NOMADSPACE_GC_KEEP]")
 	flag.StringVar(&dnsServer,
 		"dns-server", stringEnv("NOMADSPACE_DNS_SERVER", ""),
 		"DNS server to override in jobs [NOMADSPACE_DNS_SERVER]")
@@ -115,6 +386,9 @@ func run(ctx context.Context) error {
 	flag.StringVar(&dnsmasqArgs.Listen,
 		"dnsmasq-listen", stringEnv("NOMADSPACE_DNSMASQ_LISTEN", "127.0.0.1:53"),
 		"Listen address [NOMADSPACE_DNSMASQ_LISTEN]")
+	flag.StringVar(&dnsmasqExtraFlags,
+		"dnsmasq-extra-flags", stringEnv("NOMADSPACE_DNSMASQ_EXTRA_FLAGS", "--user=root"),
+		"Space separated extra flags for dnsmasq [NOMADSPACE_DNSMASQ_EXTRA_FLAGS]")
 	flag.BoolVar(&nsdnsEnable,
 		"nsdns", boolEnv("NOMADSPACE_NSDNS", false),
 		"Start DNS server and set --dns-search (--dns-server should be set to reachable IP address) [NOMADSPACE_NSDNS]")
@@ -130,7 +404,44 @@ func run(ctx context.Context) error {
 	flag.StringVar(&nsdnsArgs.ConsulDomain,
 		"nsdns-consul-domain", stringEnv("NOMADSPACE_CONSUL_DOMAIN", stringEnv("NSDNS_CONSUL_DOMAIN", "consul.")),
 		"Domain to recurse to consul [NOMADSPACE_CONSUL_DOMAIN, NSDNS_CONSUL_DOMAIN]")
-	flag.Parse()
+
+	// Command arguments may come before or after the flags
+	var params []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		params = append(params, args[0])
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	params = append(params, flag.Args()...)
+
+	if max, ok := commandArgs[command]; ok && len(params) > max {
+		return fmt.Errorf("Unexpected arguments for %v: %v", command, strings.Join(params[max:], " "))
+	} else if (command == "lint" || command == "render") && len(params) > 0 {
+		flag.Set("input-dir", params[0])
+	}
+
+	configFile = configFileFor(configFile, inputDir)
+	sources, err := loadConfig(flag.CommandLine, configFile)
+	if err != nil {
+		return err
+	}
+
+	if command == "config dump" {
+		dumpConfig(os.Stdout, flag.CommandLine, sources)
+		return nil
+	} else if command == "id" {
+		return printIds(params)
+	} else if (command == "status" || command == "destroy") && len(params) != 1 {
+		return fmt.Errorf("Expected a nomadspace id, usage: nomadspace %v <id>", command)
+	}
+
+	if namespaceMode != "prefix" && namespaceMode != "nomad" {
+		return fmt.Errorf("Invalid --namespace-mode %q, expected prefix or nomad", namespaceMode)
+	}
+
+	if dependsWait != "none" && dependsWait != "deployment" && dependsWait != "consul" {
+		return fmt.Errorf("Invalid --depends-wait %q, expected none, deployment or consul", dependsWait)
+	}
 
 	if dnsSearchConsul {
 		if dnsSearchNsDNS || dnsSearch != "" {
@@ -159,15 +470,45 @@ func run(ctx context.Context) error {
 	// See:
 	// http://lists.thekelleys.org.uk/pipermail/dnsmasq-discuss/2019q1/012840.html
 	// https://github.com/andyshinn/docker-dnsmasq/issues/6
-	dnsmasqArgs.ExtraArgs = strings.Split(stringEnv("NOMADSPACE_DNSMASQ_EXTRA_FLAGS", "--user=root"), " ")
+	dnsmasqArgs.ExtraArgs = strings.Split(dnsmasqExtraFlags, " ")
 
-	l := log.New(os.Stderr, "", log.LstdFlags)
-	l.Printf("Starting NomadSpace")
+	levels, err := logging.ParseLevels(logLevels)
+	if err != nil {
+		return err
+	}
+	if _, ok := levels[logging.Template]; !ok && !logCT && logLevel != logging.Off && hclog.LevelFromString(logLevel) < hclog.Warn {
+		levels[logging.Template] = "warn"
+	}
 
-	if !logCT {
-		log.SetOutput(ioutil.Discard)
+	loggers, err := logging.New(&logging.Options{
+		Level:  logLevel,
+		Levels: levels,
+		JSON:   logJSON,
+	})
+	if err != nil {
+		return err
 	}
 
+	// consul-template logs with the standard logger
+	log.SetOutput(loggers.Writer(logging.Template))
+	log.SetFlags(0)
+	nsdns.Logger = loggers.StdLogger(logging.Nsdns)
+
+	l := loggers.Logger(logging.Exec)
+	logger = l
+	l.Info("Starting NomadSpace")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sig
+		l.Info("Received signal, terminating...", "signal", s.String())
+		cancel()
+		signal.Stop(sig)
+	}()
+
 	tmpdir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
@@ -179,21 +520,114 @@ func run(ctx context.Context) error {
 		inputDir = "."
 	}
 
+	var depth int
+	if parentId != "" {
+		depth = intEnv("NOMADSPACE_DEPTH", 0) + 1
+	}
+
+	// A nomadspace job in a nomadspace has the id given by childNs
 	nsId := ns.Ns(jobName)
+	if parentId != "" {
+		nsId = ns.Child(parentId, jobName)
+	}
 	ns := &NomadSpace{
-		Id:            nsId,
-		PrintRendered: printRendered,
-		RenderedDir:   tmpdir,
-		VerboseCT:     verboseCT,
-		DNSSearch:     strings.Replace(dnsSearch, "${NS}", nsId, -1),
-		DNSServer:     dnsServer,
+		Id:                    nsId,
+		Parent:                parentId,
+		Owner:                 jobName,
+		Depth:                 depth,
+		InputDir:              inputDir,
+		PrintRendered:         printRendered,
+		RenderedDir:           tmpdir,
+		VerboseCT:             verboseCT,
+		DNSSearch:             strings.Replace(dnsSearch, "${NS}", nsId, -1),
+		DNSServer:             dnsServer,
+		GC:                    gcEnable,
+		GCDryRun:              gcDryRun,
+		GCPurge:               gcPurge,
+		GCKeep:                strings.Split(gcKeep, ","),
+		Teardown:              teardown,
+		TeardownTimeout:       teardownTimeout,
+		Plan:                  plan || planDenyDestructive,
+		PlanDenyDestructive:   planDenyDestructive,
+		Watch:                 watch,
+		WatchDelay:            watchDelay,
+		InjectEnv:             injectEnv,
+		KeysPrefix:            keysPrefix,
+		KeysOverwrite:         keysOverwrite,
+		NomadNamespace:        namespaceMode == "nomad",
+		PrefixServices:        prefixServices,
+		Wait:                  wait,
+		WaitTimeout:           waitTimeout,
+		DependsWait:           dependsWait,
+		Partial:               partial,
+		SubmitRetryAttempts:   submitRetryAttempts,
+		SubmitRetryBackoff:    submitRetryBackoff,
+		SubmitRetryMaxBackoff: submitRetryMaxBackoff,
+		TemplateConfig:        config.DefaultConfig(),
+		jobState:              newJobState(),
 	}
 
-	l.Printf("NomadSpace id:           %v", ns.Id)
-	l.Printf("NomadSpace source dir:   %v", inputDir)
-	l.Printf("NomadSpace rendered dir: %v", tmpdir)
+	vaultClient, err := vaultOpts.client()
+	if err != nil {
+		return err
+	}
+
+	var retry = &config.RetryConfig{
+		Enabled:    config.Bool(true),
+		Attempts:   config.Int(templateRetryAttempts),
+		Backoff:    config.TimeDuration(templateRetryBackoff),
+		MaxBackoff: config.TimeDuration(templateRetryMaxBackoff),
+	}
+	ns.TemplateConfig.Consul = consulOpts.templateConfig()
+	ns.TemplateConfig.Consul.Retry = retry.Copy()
+	ns.TemplateConfig.Vault = vaultOpts.templateConfig(vaultClient)
+	ns.TemplateConfig.Vault.Retry = retry.Copy()
+	if templateWaitMin > 0 {
+		ns.TemplateConfig.Wait = &config.WaitConfig{
+			Enabled: config.Bool(true),
+			Min:     config.TimeDuration(templateWaitMin),
+		}
+		if templateWaitMax > 0 {
+			ns.TemplateConfig.Wait.Max = config.TimeDuration(templateWaitMax)
+		}
+	}
+
+	l.Info("NomadSpace", "nomadspace", ns.Id, "dir", inputDir, "rendered_dir", tmpdir)
+
+	nomadConfig, err := nomadOpts.config(vaultClient)
+	if err != nil {
+		return err
+	}
 
-	ns.nomadClient, err = api.NewClient(api.DefaultConfig())
+	ns.nomadClient, err = api.NewClient(nomadConfig)
+	if err != nil {
+		return err
+	}
+
+	if command == "lint" {
+		return ns.runLint(ctx, l, inputDir, nomadConfig.Address, renderTimeout, allowOffline)
+	} else if command == "render" {
+		return ns.runRender(ctx, l, inputDir, renderFixtures, renderOutputDir, renderTimeout)
+	} else if command == "list" {
+		return ns.runList()
+	} else if command == "tree" {
+		return ns.runTree()
+	} else if command == "status" {
+		return ns.runStatus(params[0])
+	} else if command == "destroy" {
+		return ns.runDestroy(l, params[0], purge)
+	}
+
+	err = ns.checkNomad(l, nomadConfig.Address)
+	if err != nil {
+		return err
+	}
+
+	if nomadOpts.TokenVaultPath != "" {
+		go nomadOpts.renewToken(ctx, l, vaultClient, ns.nomadClient)
+	}
+
+	ns.consulClient, err = consulapi.NewClient(consulOpts.apiConfig())
 	if err != nil {
 		return err
 	}
@@ -208,7 +642,13 @@ func run(ctx context.Context) error {
 
 	if dnsmasqEnable {
 		wg.Start(func() error {
-			return dnsmasq.Run(ctx, l, &dnsmasqArgs)
+			return dnsmasq.Run(ctx, loggers.StdLogger(logging.Dnsmasq), &dnsmasqArgs)
+		})
+	}
+
+	if httpListen != "" {
+		wg.Start(func() error {
+			return ns.serveHTTP(ctx, l, httpListen)
 		})
 	}
 
@@ -220,107 +660,509 @@ func run(ctx context.Context) error {
 }
 
 type NomadSpace struct {
-	Id            string
-	PrintRendered bool
-	VerboseCT     bool
-	RenderedDir   string
-	DNSSearch     string
-	DNSServer     string
+	Id                    string
+	Parent                string
+	Owner                 string // job name of the nomadspace job
+	Depth                 int    // number of parent nomadspaces
+	InputDir              string
+	Env                   map[string]string
+	InjectEnv             bool
+	KeysPrefix            string
+	KeysOverwrite         bool
+	NomadNamespace        bool
+	PrefixServices        bool
+	Wait                  bool
+	WaitTimeout           time.Duration
+	DependsWait           string
+	Partial               bool // submit valid jobs and retry failed ones
+	SubmitRetryAttempts   int
+	SubmitRetryBackoff    time.Duration
+	SubmitRetryMaxBackoff time.Duration
+	TemplateConfig        *config.Config // consul-template configuration without templates
+	PrintRendered         bool
+	VerboseCT             bool
+	RenderedDir           string
+	DNSSearch             string
+	DNSServer             string
+	GC                    bool
+	GCDryRun              bool
+	GCPurge               bool
+	GCKeep                []string
+	Teardown              bool
+	TeardownTimeout       time.Duration
+	Plan                  bool
+	PlanDenyDestructive   bool
+	Watch                 bool
+	WatchDelay            time.Duration
+
+	nomadClient  *api.Client
+	consulClient *consulapi.Client
+	offline      bool // Nomad agent unreachable, .nomad files are skipped
+
+	*jobState
+}
 
-	nomadClient *api.Client
+type jobState struct {
+	mu        sync.Mutex
+	jobs      map[string]string // source file name -> job id
+	submitted map[string]bool   // job ids submitted since startup
+	children  map[string]*childSpace
+	keys      map[string]bool        // consul keys written from .keys files
+	states    map[string]string      // job id -> final state after submission
+	evals     map[string]string      // job id -> last evaluation id
+	files     map[string]*fileStatus // source file name -> status
+	inputDir  string
+	ready     bool       // initial submission succeeded
+	waitErrs  chan error // failures of jobs waited for in the background
 }
 
-func (ns *NomadSpace) exec(ctx context.Context, l *log.Logger, inputDir string) error {
-	f, err := os.Open(inputDir)
+func newJobState() *jobState {
+	return &jobState{
+		jobs:      map[string]string{},
+		submitted: map[string]bool{},
+		children:  map[string]*childSpace{},
+		keys:      map[string]bool{},
+		states:    map[string]string{},
+		evals:     map[string]string{},
+		files:     map[string]*fileStatus{},
+		waitErrs:  make(chan error, 1),
+	}
+}
+
+func (ns *NomadSpace) exec(ctx context.Context, l hclog.Logger, inputDir string) (err error) {
+	defer func() {
+		if !ns.Teardown || ctx.Err() == nil {
+			return
+		}
+		if e := ns.teardown(l); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}()
+
+	defer func() {
+		if e := ns.stopChildren(); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}()
+
+	if ns.NomadNamespace {
+		err = ns.ensureNamespace(l)
+		if err != nil {
+			return err
+		}
+	}
+
+	var changes <-chan struct{}
+	if ns.Watch {
+		changes, err = watchDir(ctx, l, inputDir, ns.WatchDelay)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		err = ns.execOnce(ctx, l, inputDir, changes)
+		if err == errChanged {
+			l.Info("Input dir changed, reloading...", "dir", inputDir)
+			continue
+		} else if changes == nil || ctx.Err() != nil {
+			return err
+		} else if err != nil {
+			l.Error("Failed to submit input dir", "dir", inputDir, "error", err)
+		}
+
+		l.Info("Waiting for changes in input dir...", "dir", inputDir)
+		select {
+		case <-changes:
+			l.Info("Input dir changed, reloading...", "dir", inputDir)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// execOnce reads the input directory and submits the jobs it contains. It
+// returns errChanged if a change is signaled on the changes channel.
+func (ns *NomadSpace) execOnce(ctx context.Context, l hclog.Logger, inputDir string, changes <-chan struct{}) error {
+	in, err := ns.readInputDir(l, inputDir)
+	if in == nil {
+		return err
+	}
+	ns.setStatusFiles(inputDir, in.files)
+	if err != nil && !ns.Partial {
+		return err
+	} else if err != nil {
+		l.Error("Failed to read input dir", "dir", inputDir, "error", err)
+		err = nil
+	}
+
+	var keyFiles []string
+	for fname := range in.keys {
+		keyFiles = append(keyFiles, fname)
+	}
+	sort.Strings(keyFiles)
+	for _, fname := range keyFiles {
+		e := ns.writeKeys(l, fname, in.keys[fname])
+		ns.setFileError(fname, e)
+		if e != nil {
+			in.failed = append(in.failed, fname)
+			err = multierror.Append(err, e).ErrorOrNil()
+		}
+	}
+	if err != nil && !ns.Partial {
+		return err
+	} else if err != nil {
+		l.Error("Failed to write keys", "error", err)
+		err = nil
+	}
+
+	childEnv := ns.startChildren(ctx, l, inputDir, in.dirs)
+
+	err = ns.deregisterRemoved(l, in.sources)
 	if err != nil {
 		return err
 	}
 
+	order, err := sortJobs(in.jobs)
+	if err != nil && !ns.Partial {
+		return err
+	} else if err != nil {
+		// Jobs in the cycle or depending on it are broken until the
+		// files are fixed
+		l.Error("Failed to order jobs", "error", err)
+		var sorted = map[string]bool{}
+		for _, fname := range order {
+			sorted[fname] = true
+		}
+		for fname := range in.jobs {
+			if !sorted[fname] {
+				ns.setFileBroken(fname, err)
+			}
+		}
+		err = nil
+	}
+
+	var evals = map[string]string{}
+	for _, fname := range order {
+		evalID, e := ns.runJob(ctx, l, fname, in.jobs[fname], in.jobEnvs[fname])
+		if e != nil {
+			in.failed = append(in.failed, fname)
+			err = multierror.Append(err, e).ErrorOrNil()
+		} else if evalID != "" {
+			evals[fname] = evalID
+		}
+	}
+	if err != nil && !ns.Partial {
+		return err
+	} else if err != nil {
+		l.Error("Failed to submit jobs", "error", err)
+		err = nil
+	}
+
+	if ns.Wait {
+		wg := waitgroup.New()
+		for fname, evalID := range evals {
+			wg.Start(func(fname, id, evalID string) waitgroup.Func {
+				return func() error {
+					_, err := ns.waitJob(ctx, l, fname, id, evalID)
+					return err
+				}
+			}(fname, *in.jobs[fname].ID, evalID))
+		}
+		err = wg.Wait()
+		if err != nil {
+			return err
+		}
+	}
+
+	tctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(in.failed) > 0 {
+		sort.Strings(in.failed)
+		go ns.retryFiles(tctx, l, inputDir, in.failed, in.dirEnv, in.jobTemplates)
+	} else if len(in.jobTemplates) == 0 {
+		ns.checkReady(l, nil)
+	}
+
+	if len(in.groups) == 1 && len(*in.groups[0].cfg.Templates) == 0 {
+		l.Info("Jobs are submitted, waiting forever...")
+		select {
+		case <-changes:
+			return errChanged
+		case err = <-ns.waitErrs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	wg := waitgroup.New()
+	for _, group := range in.groups {
+		if len(*group.cfg.Templates) == 0 {
+			continue
+		}
+		group.env = copyEnv(group.env)
+		for k, v := range childEnv {
+			group.env[k] = v
+		}
+		wg.Start(func(group *templateGroup) waitgroup.Func {
+			return func() error {
+				err := ns.runTemplates(tctx, l, group, in.jobTemplates)
+				if err != nil && tctx.Err() == nil {
+					// Stop the other templates on error
+					cancel()
+				} else if err != nil && ctx.Err() == nil {
+					// Stopped because of another template error
+					return nil
+				}
+				return err
+			}
+		}(group))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wg.Wait()
+	}()
+
+	select {
+	case <-changes:
+		l.Info("Template stopped for reload")
+		cancel()
+		<-done
+		return errChanged
+	case err = <-ns.waitErrs:
+		l.Error("Template stopped after a failed deployment")
+		cancel()
+		<-done
+		return err
+	case err = <-done:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+}
+
+// inputFiles are the files read from an input directory
+type inputFiles struct {
+	dirEnv       map[string]string
+	jobs         map[string]*api.Job
+	jobEnvs      map[string]map[string]string
+	jobTemplates []string
+	sources      map[string]bool
+	dirs         map[string]map[string]string
+	keys         map[string]map[string]string
+	groups       []*templateGroup
+	files        []string
+	failed       []string // files failing to be read or submitted
+	skipped      []string // .nomad files skipped when offline
+}
+
+// readInputDir reads the jobs, templates, keys and child nomadspaces of the
+// input directory. It returns the errors of the files that could not be
+// read along with the other files, or no files if the input directory could
+// not be read.
+func (ns *NomadSpace) readInputDir(l hclog.Logger, inputDir string) (*inputFiles, error) {
+	f, err := os.Open(inputDir)
+	if err != nil {
+		return nil, err
+	}
+
 	defer f.Close()
 	names, err := f.Readdirnames(-1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sort.Strings(names)
 
-	l.Printf("Found %d files in input dir %s", len(names), inputDir)
+	l.Info("Found files in input dir", "dir", inputDir, "files", len(names))
 
-	var jobs = map[string]*api.Job{}
-	var cfg *config.Config = config.DefaultConfig()
+	dirEnv, found, err := readEnvFileIfExists(path.Join(inputDir, EnvironmentFile), ns.Env)
+	if err != nil {
+		return nil, err
+	} else if found {
+		l.Info("Read environment", "file", path.Join(inputDir, EnvironmentFile))
+	}
+
+	var in = &inputFiles{
+		dirEnv:  dirEnv,
+		jobs:    map[string]*api.Job{},
+		jobEnvs: map[string]map[string]string{},
+		sources: map[string]bool{},
+		dirs:    map[string]map[string]string{},
+		keys:    map[string]map[string]string{},
+		groups:  []*templateGroup{{cfg: ns.templateConfig(), env: dirEnv}},
+	}
+
+	// Templates are given to consul-template once, they cannot be read
+	// again until the input directory changes and are not retried
+	var fail = func(name string, e error) {
+		if strings.HasSuffix(name, ".tmpl") {
+			ns.setFileBroken(name, e)
+		} else {
+			ns.setFileError(name, e)
+			in.failed = append(in.failed, name)
+		}
+		in.sources[name] = true
+		err = multierror.Append(err, e).ErrorOrNil()
+	}
 
 	for _, name := range names {
 		var job *api.Job
 		var e error
 		var fname = path.Join(inputDir, name)
-		if strings.HasSuffix(name, ".json") {
-			l.Printf("Read JSON %v", fname)
+		if info, e := os.Stat(fname); e == nil && info.IsDir() {
+			if strings.HasSuffix(name, ".nomad") {
+				l.Info("Read NomadSpace", "file", fname)
+				in.dirs[name], e = ns.readJobEnv(l, inputDir, name, dirEnv)
+				if e != nil {
+					err = multierror.Append(err, e).ErrorOrNil()
+					if ns.Partial {
+						l.Error("Failed to read NomadSpace", "file", fname, "error", e)
+						// A running child nomadspace keeps its
+						// environment and jobs, the directory is
+						// broken until the environment is fixed
+						in.files = append(in.files, name)
+						ns.setFileBroken(name, e)
+						if c, ok := ns.children[name]; ok {
+							in.dirs[name] = c.ns.Env
+						} else {
+							delete(in.dirs, name)
+						}
+					}
+				}
+			} else {
+				l.Debug("Ignore", "file", fname)
+			}
+			continue
+		}
+		if name == EnvironmentFile || name == ConfigFile || strings.HasSuffix(name, ".env") {
+			continue
+		}
+		var jobEnv map[string]string
+		jobEnv, e = ns.readJobEnv(l, inputDir, name, dirEnv)
+		if e != nil {
+			in.files = append(in.files, name)
+			fail(name, e)
+			continue
+		}
+		if strings.HasSuffix(name, ".keys") {
+			l.Info("Read keys", "file", fname)
+			in.keys[name], e = readKeys(fname)
+		} else if strings.HasSuffix(name, ".json") {
+			l.Info("Read JSON", "file", fname)
 			job, e = readJSON(fname)
+		} else if strings.HasSuffix(name, ".nomad") && ns.offline {
+			l.Warn("Skip .nomad file, .nomad files are parsed by the Nomad agent", "file", fname)
+			in.skipped = append(in.skipped, name)
+			continue
 		} else if strings.HasSuffix(name, ".nomad") {
-			l.Printf("Read Nomad %v", fname)
+			l.Info("Read Nomad", "file", fname)
 			job, e = readNomadAPI(ns.nomadClient, fname)
 		} else if strings.HasSuffix(name, ".tmpl") {
-			l.Printf("Read Template %v", fname)
+			l.Info("Read template", "file", fname)
 			var templ *config.TemplateConfig
 			templ, e = ns.readTemplate(fname, path.Base(fname[:len(fname)-5]))
 			if e == nil {
-				*cfg.Templates = append(*cfg.Templates, templ)
+				ns.setFileError(name, nil)
+				group := in.groups[0]
+				if !reflect.DeepEqual(jobEnv, dirEnv) {
+					group = &templateGroup{cfg: ns.templateConfig(), env: jobEnv}
+					in.groups = append(in.groups, group)
+				}
+				*group.cfg.Templates = append(*group.cfg.Templates, templ)
+				if strings.HasSuffix(name, ".json.tmpl") || strings.HasSuffix(name, ".nomad.tmpl") {
+					in.jobTemplates = append(in.jobTemplates, name)
+					in.sources[name] = true
+				}
 			}
 		} else {
-			l.Printf("Ignore %v", fname)
+			l.Debug("Ignore", "file", fname)
+			continue
 		}
+		in.files = append(in.files, name)
 		if e != nil {
-			err = multierror.Append(err, e).ErrorOrNil()
+			fail(name, e)
 		} else if job != nil {
-			jobs[name] = job
+			in.jobs[name] = job
+			in.jobEnvs[name] = jobEnv
+			in.sources[name] = true
 		}
 	}
-	if err != nil {
-		return err
+	return in, err
+}
+
+// readJobEnv reads the environment file for a job source file or a child
+// nomadspace directory, layered on top of the directory environment.
+func (ns *NomadSpace) readJobEnv(l hclog.Logger, inputDir, name string, dirEnv map[string]string) (map[string]string, error) {
+	fname := path.Join(inputDir, jobBaseName(name)+".env")
+	env, found, err := readEnvFileIfExists(fname, dirEnv)
+	if found && err == nil {
+		l.Info("Read environment", "file", fname)
 	}
+	return env, err
+}
 
-	for fname, job := range jobs {
-		e := ns.runJob(l, fname, job)
-		if e != nil {
-			err = multierror.Append(err, e).ErrorOrNil()
-		}
+// templateConfig returns a new consul-template configuration without
+// templates, with the nomadspace Consul, Vault, wait and retry settings
+func (ns *NomadSpace) templateConfig() *config.Config {
+	if ns.TemplateConfig == nil {
+		return config.DefaultConfig()
 	}
-	if err != nil {
-		return err
+	return ns.TemplateConfig.Copy()
+}
+
+// templateEnv returns the environment variables of the templates: the
+// process environment, the given environment and the nomadspace variables
+func (ns *NomadSpace) templateEnv(env map[string]string) map[string]string {
+	var res = map[string]string{}
+
+	for _, env := range os.Environ() {
+		vals := strings.SplitN(env, "=", 2)
+		res[vals[0]] = vals[1]
 	}
 
-	if len(*cfg.Templates) == 0 {
-		l.Printf("Jobs are submitted, waiting forever...")
-		<-ctx.Done()
-		return ctx.Err()
+	for k, v := range env {
+		res[k] = v
 	}
 
+	res["GEN_DIR"] = ns.RenderedDir
+	res["NOMADSPACE_ID"] = ns.Id
+	res["NS"] = ns.Id
+	return res
+}
+
+// templateGroup is a set of templates rendered by the same consul-template
+// runner with the same environment.
+type templateGroup struct {
+	cfg *config.Config
+	env map[string]string
+}
+
+// runTemplates runs consul-template on the group templates, with the group
+// environment variables, and submits the rendered jobs.
+func (ns *NomadSpace) runTemplates(ctx context.Context, l hclog.Logger, group *templateGroup, jobTemplates []string) error {
+	cfg := group.cfg
+	env := group.env
 	for {
 		runner, err := manager.NewRunner(cfg, false)
 		if err != nil {
 			return err
 		}
 
-		runner.Env = map[string]string{}
+		runner.Env = ns.templateEnv(env)
 
-		l.Println()
 		if !ns.VerboseCT {
-			l.Println("Running consul-template silently...")
+			l.Info("Running consul-template silently...")
 			runner.SetOutStream(ioutil.Discard)
 			runner.SetErrStream(ioutil.Discard)
 		} else {
-			l.Println("Running consul-template with full logs...")
+			l.Info("Running consul-template with full logs...")
 		}
 
-		for _, env := range os.Environ() {
-			vals := strings.SplitN(env, "=", 2)
-			runner.Env[vals[0]] = vals[1]
-		}
-
-		runner.Env["GEN_DIR"] = ns.RenderedDir
-		runner.Env["NOMADSPACE_ID"] = ns.Id
-		runner.Env["NS"] = ns.Id
-
 		now := time.Now()
 		go runner.Start()
 
@@ -328,67 +1170,113 @@ func (ns *NomadSpace) exec(ctx context.Context, l *log.Logger, inputDir string)
 		started := true
 		numMissingDeps := 0
 		numRendering := 0
+		pending := map[string][]byte{} // rendered contents failing to submit
+		attempt := 0
+		var retry <-chan time.Time
 		for started {
 			var next = now
-			l.Println()
+			var submitted = false
+			var retrying = false
 			select {
 			case <-runner.DoneCh:
-				l.Printf("Template done.")
+				l.Info("Template done")
 				started = false
 			case err = <-runner.ErrCh:
-				l.Printf("Template error: %v", err)
+				l.Error("Template failed", "error", err)
 				started = false
 			case <-runner.TemplateRenderedCh():
-				l.Printf("Template rendered...")
+				l.Debug("Template rendered...")
 			case <-runner.RenderEventCh():
-				l.Printf("Template events...")
+				l.Debug("Template events...")
+			case <-retry:
+				l.Debug("Template retry...")
+				retrying = true
+			case <-ctx.Done():
+				l.Info("Template cancelled")
+				runner.Stop()
+				return ctx.Err()
 			}
-			i := 0
 			for eventId, event := range runner.RenderEvents() {
-				i += 1
-				_ = eventId
 				if now.After(event.UpdatedAt) {
-					//l.Printf("... received event %v: updated before last check (%v < %v)", eventId, event.UpdatedAt, now)
+					l.Trace("Event updated before last check", "event", eventId, "updated", event.UpdatedAt, "last", now)
 					continue
 				} else if next.Before(event.UpdatedAt) {
-					//l.Printf("... received event %v: updated at %v", eventId, event.UpdatedAt)
+					l.Trace("Event updated", "event", eventId, "updated", event.UpdatedAt)
 					next = event.UpdatedAt
 				}
 
 				fname := path.Base(*event.TemplateConfigs[0].Source)
+				var missingDeps []string
 				if event.MissingDeps != nil {
 					for _, dep := range event.MissingDeps.List() {
-						l.Printf("[%d] Missing dep for %v: %v (%v)", i, fname, dep, event.UpdatedAt)
+						l.Info("Missing dependency", "file", fname, "dependency", dep.String(), "updated", event.UpdatedAt)
+						missingDeps = append(missingDeps, dep.String())
 						numMissingDeps += 1
 					}
 				}
+				ns.updateStatus(fname, func(s *fileStatus) {
+					s.MissingDeps = missingDeps
+				})
+				templateMissingDeps.WithLabelValues(ns.Id, fname).Set(float64(len(missingDeps)))
 
 				if len(event.Contents) > 0 {
 					numRendering += 1
+					templateRenders.WithLabelValues(ns.Id, fname).Inc()
 					if ns.PrintRendered {
-						l.Printf("[%d] Rendered %v: (%v)\n%s", i, fname, event.UpdatedAt, string(event.Contents))
+						l.Info("Rendered", "file", fname, "updated", event.UpdatedAt, "contents", string(event.Contents))
 					} else {
-						l.Printf("[%d] Rendered %v (%v)", i, fname, event.UpdatedAt)
-					}
-					err = nil
-					if strings.HasSuffix(fname, ".json.tmpl") {
-						err = ns.runJSONJob(l, fname, event.Contents)
-					} else if strings.HasSuffix(fname, ".nomad.tmpl") {
-						err = ns.runNomadJob(l, fname, event.Contents)
+						l.Info("Rendered", "file", fname, "updated", event.UpdatedAt)
 					}
+					err = ns.submitRendered(ctx, l, fname, event.Contents, env)
 					if err != nil {
-						l.Printf("[%d] ERROR rendering %v: %v", i, fname, err)
+						l.Error("Failed to submit rendered template", "file", fname, "error", err)
+						if !ns.Partial {
+							runner.Stop()
+							return err
+						}
+						pending[fname] = event.Contents
+					} else {
+						delete(pending, fname)
+						submitted = true
+					}
+					err = nil
+				}
+			}
+			if retrying {
+				for _, fname := range pendingNames(pending) {
+					e := ns.submitRendered(ctx, l, fname, pending[fname], env)
+					if e != nil {
+						l.Error("Retry failed", "file", fname, "error", e)
+					} else {
+						delete(pending, fname)
+						submitted = true
 					}
 				}
 			}
-			//l.Printf("Handled events updated last at %v", next)
+			if len(pending) == 0 {
+				attempt = 0
+				retry = nil
+				ns.setRetry(nil, 0, time.Time{})
+			} else if retry == nil || retrying {
+				fnames := pendingNames(pending)
+				attempt += 1
+				delay := ns.retryBackoff(attempt)
+				retry = time.After(delay)
+				ns.setRetry(fnames, attempt, time.Now().Add(delay))
+				l.Warn("Stuck templates", "files", strings.Join(fnames, ", "), "attempt", attempt, "delay", delay)
+			}
+			if submitted {
+				ns.checkReady(l, jobTemplates)
+			}
+			l.Trace("Handled events", "updated", next)
 			now = next
 		}
-		l.Printf("Templating stopped.")
+		l.Info("Templating stopped")
 		if err != nil && numRendering > 0 {
 			// In case of errors, but some files have been rendered
 			// retry
-			l.Printf("Template error, retry templating.")
+			l.Warn("Template failed, retry templating")
+			templateRestarts.WithLabelValues(ns.Id).Inc()
 			continue
 		} else {
 			break
@@ -398,6 +1286,37 @@ func (ns *NomadSpace) exec(ctx context.Context, l *log.Logger, inputDir string)
 	return nil
 }
 
+// deregisterRemoved deregisters the jobs previously submitted from source
+// files that are no longer present.
+func (ns *NomadSpace) deregisterRemoved(l hclog.Logger, sources map[string]bool) error {
+	var err error
+
+	ns.mu.Lock()
+	var removed = map[string]string{}
+	for fname, id := range ns.jobs {
+		if !sources[fname] {
+			removed[fname] = id
+		}
+	}
+	ns.mu.Unlock()
+
+	for fname, id := range removed {
+		evalID, _, e := ns.nomadClient.Jobs().Deregister(id, false, ns.writeOptions())
+		if e != nil {
+			l.Error("Failed to deregister removed job", "file", fname, "job", id, "error", e)
+			err = multierror.Append(err, fmt.Errorf("failed to deregister %v as %v, %v", fname, id, e)).ErrorOrNil()
+			continue
+		}
+		l.Info("Deregistered removed job", "file", fname, "job", id, "eval", evalID)
+		ns.mu.Lock()
+		delete(ns.jobs, fname)
+		delete(ns.submitted, id)
+		ns.mu.Unlock()
+	}
+
+	return err
+}
+
 func readJSON(fname string) (*api.Job, error) {
 	f, err := os.Open(fname)
 	if err != nil {
@@ -433,7 +1352,12 @@ func (ns *NomadSpace) readTemplate(fname, dstname string) (*config.TemplateConfi
 	var cfg = config.DefaultTemplateConfig()
 	var dst = path.Join(ns.RenderedDir, dstname)
 
-	cfg.Source = &fname
+	src, err := expandTemplateFile(ns, fname)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to expand template helpers in %v, %v", fname, err)
+	}
+
+	cfg.Source = &src
 	cfg.LeftDelim = &DefaultLeftDelim
 	cfg.RightDelim = &DefaultRightDelim
 	cfg.Destination = &dst
@@ -442,63 +1366,194 @@ func (ns *NomadSpace) readTemplate(fname, dstname string) (*config.TemplateConfi
 	return cfg, nil
 }
 
-func (ns *NomadSpace) runJSONJob(l *log.Logger, fname string, content []byte) error {
-	var job api.Job
+// submitRendered submits the rendered job, or writes the rendered Consul
+// keys, and records the outcome in the template status
+func (ns *NomadSpace) submitRendered(ctx context.Context, l hclog.Logger, fname string, contents []byte, env map[string]string) error {
+	var evalID string
+	var err error
+	if strings.HasSuffix(fname, ".json.tmpl") {
+		evalID, err = ns.runJSONJob(ctx, l, fname, contents, env)
+	} else if strings.HasSuffix(fname, ".nomad.tmpl") {
+		evalID, err = ns.runNomadJob(ctx, l, fname, contents, env)
+	} else if strings.HasSuffix(fname, ".keys.tmpl") {
+		err = ns.runKeys(l, fname, contents)
+	}
+	ns.setFileError(fname, err)
+	if evalID != "" && ns.Wait {
+		go ns.waitBackground(ctx, l, fname, ns.jobID(fname), evalID)
+	}
+	return err
+}
+
+// parseRendered parses a rendered JSON or HCL job template
+func (ns *NomadSpace) parseRendered(fname string, content []byte) (*api.Job, error) {
+	var job *api.Job
+	var err error
+	if strings.HasSuffix(fname, ".json.tmpl") {
+		job = &api.Job{}
+		err = json.NewDecoder(bytes.NewReader(content)).Decode(job)
+	} else {
+		job, err = ns.nomadClient.Jobs().ParseHCL(string(content), true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse rendered %v, %v", fname, err)
+	}
+	return job, nil
+}
 
-	r := bytes.NewReader(content)
-	err := json.NewDecoder(r).Decode(&job)
+func (ns *NomadSpace) runJSONJob(ctx context.Context, l hclog.Logger, fname string, content []byte, env map[string]string) (string, error) {
+	job, err := ns.parseRendered(fname, content)
 	if err != nil {
-		return fmt.Errorf("Failed to parse rendered %v, %v", fname, err)
+		return "", err
 	}
 
-	return ns.runJob(l, fname, &job)
+	return ns.runJob(ctx, l, fname, job, env)
 }
 
-func (ns *NomadSpace) runNomadJob(l *log.Logger, fname string, content []byte) error {
-	job, err := ns.nomadClient.Jobs().ParseHCL(string(content), true)
+func (ns *NomadSpace) runNomadJob(ctx context.Context, l hclog.Logger, fname string, content []byte, env map[string]string) (string, error) {
+	job, err := ns.parseRendered(fname, content)
+	if err != nil {
+		return "", err
+	}
+
+	return ns.runJob(ctx, l, fname, job, env)
+}
+
+func (ns *NomadSpace) runKeys(l hclog.Logger, fname string, content []byte) error {
+	keys, err := parseKeys(fname, content)
 	if err != nil {
 		return fmt.Errorf("Failed to parse rendered %v, %v", fname, err)
 	}
 
-	return ns.runJob(l, fname, job)
+	return ns.writeKeys(l, fname, keys)
 }
 
-func (ns *NomadSpace) prefix(name string) string {
-	if !strings.HasPrefix(name, ns.Id+"-") {
-		name = ns.Id + "-" + name
+// queryOptions returns the Nomad query options for the nomadspace
+func (ns *NomadSpace) queryOptions() *api.QueryOptions {
+	var q = &api.QueryOptions{}
+	if ns.NomadNamespace {
+		q.Namespace = ns.Id
 	}
-	return name
+	return q
 }
 
-func (ns *NomadSpace) namespaceJob(job *api.Job) {
-	name := ns.prefix(*job.ID)
-	job.ID = &name
+// writeOptions returns the Nomad write options for the nomadspace
+func (ns *NomadSpace) writeOptions() *api.WriteOptions {
+	var q = &api.WriteOptions{}
+	if ns.NomadNamespace {
+		q.Namespace = ns.Id
+	}
+	return q
+}
+
+// ensureNamespace creates the Nomad namespace for the nomadspace if it does
+// not exist.
+func (ns *NomadSpace) ensureNamespace(l hclog.Logger) error {
+	_, _, err := ns.nomadClient.Namespaces().Info(ns.Id, nil)
+	if err == nil {
+		return nil
+	}
+
+	var desc = "NomadSpace " + ns.Id
+	if ns.Parent != "" {
+		desc += " (parent " + ns.Parent + ")"
+	}
+
+	_, err = ns.nomadClient.Namespaces().Register(&api.Namespace{
+		Name:        ns.Id,
+		Description: desc,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create namespace %v, %v", ns.Id, err)
+	}
+
+	l.Info("Created Nomad namespace", "namespace", ns.Id)
+	return nil
+}
+
+func (ns *NomadSpace) prefix(name string) string {
+	return prefixName(ns.Id, name)
+}
+
+func (ns *NomadSpace) namespaceJob(job *api.Job, fname string, env map[string]string) {
+	if ns.NomadNamespace {
+		job.Namespace = &ns.Id
+	} else {
+		id := ns.prefix(*job.ID)
+		job.ID = &id
+	}
 	if job.Meta == nil {
 		job.Meta = map[string]string{}
 	}
 	job.Meta["ns"] = ns.Id
 	job.Meta["ns.prefix"] = ns.Id + "-"
+	if ns.Parent != "" {
+		job.Meta["ns.parent"] = ns.Parent
+	}
+	if ns.Owner != "" {
+		job.Meta["ns.owner"] = ns.Owner
+	}
+	job.Meta["ns.source"] = path.Join(ns.InputDir, fname)
+	job.Meta["ns.depth"] = strconv.Itoa(ns.Depth)
 	for _, group := range job.TaskGroups {
+		if ns.PrefixServices {
+			for _, service := range group.Services {
+				ns.namespaceService(service)
+			}
+		}
 		for _, task := range group.Tasks {
 			if task.Env == nil {
 				task.Env = map[string]string{}
 			}
+			if ns.InjectEnv {
+				for k, v := range env {
+					if _, ok := task.Env[k]; !ok {
+						task.Env[k] = v
+					}
+				}
+			}
 			task.Env["NOMADSPACE_ID"] = ns.Id
-			switch task.Driver {
-			case "docker", "rkt":
-				if ns.DNSSearch != "" {
-					searchDomains := toStringList(task.Config["dns_search_domains"])
-					searchDomains = append(searchDomains, ns.DNSSearch)
-					task.Config["dns_search_domains"] = searchDomains
+			task.Env["NOMADSPACE_DEPTH"] = strconv.Itoa(ns.Depth)
+			if ns.Parent != "" {
+				task.Env["NOMADSPACE_PARENT"] = ns.Parent
+			}
+			ns.namespaceDNS(group, task)
+			if ns.PrefixServices {
+				for _, service := range task.Services {
+					ns.namespaceService(service)
 				}
-				if ns.DNSServer != "" {
-					servers := toStringList(task.Config["dns_servers"])
-					servers = append(servers, ns.DNSServer)
-					task.Config["dns_servers"] = servers
+			}
+		}
+	}
+}
+
+// namespaceService prefixes the service name, the Consul Connect upstreams
+// it points to and the services exposed by Consul Connect gateways.
+func (ns *NomadSpace) namespaceService(service *api.Service) {
+	service.Name = ns.prefix(service.Name)
+	if service.Connect == nil {
+		return
+	}
+	if sidecar := service.Connect.SidecarService; sidecar != nil && sidecar.Proxy != nil {
+		for _, upstream := range sidecar.Proxy.Upstreams {
+			upstream.DestinationName = ns.prefix(upstream.DestinationName)
+		}
+	}
+	if gateway := service.Connect.Gateway; gateway != nil {
+		if gateway.Ingress != nil {
+			for _, listener := range gateway.Ingress.Listeners {
+				for _, s := range listener.Services {
+					// The wildcard exposes every service of the
+					// listener protocol
+					if s.Name != "*" {
+						s.Name = ns.prefix(s.Name)
+					}
 				}
 			}
-			for _, service := range task.Services {
-				service.Name = ns.prefix(service.Name)
+		}
+		if gateway.Terminating != nil {
+			for _, s := range gateway.Terminating.Services {
+				s.Name = ns.prefix(s.Name)
 			}
 		}
 	}
@@ -513,21 +1568,144 @@ func toStringList(val interface{}) []string {
 		return []string{v}
 	case []string:
 		return v
+	case []interface{}:
+		var res []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
 	default:
 		return nil
 	}
 }
 
-func (ns *NomadSpace) runJob(l *log.Logger, fname string, job *api.Job) error {
-	ns.namespaceJob(job)
-	res, _, err := ns.nomadClient.Jobs().Register(job, nil)
+// jobHash returns a hash of the job content, ignoring the "ns.hash" metadata
+// where it is stored.
+func jobHash(job *api.Job) (string, error) {
+	var meta = job.Meta
+	job.Meta = map[string]string{}
+	for k, v := range meta {
+		if k != "ns.hash" {
+			job.Meta[k] = v
+		}
+	}
+	data, err := json.Marshal(job)
+	job.Meta = meta
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// jobUnchanged returns true if the job is already running in Nomad with the
+// same hash.
+func (ns *NomadSpace) jobUnchanged(job *api.Job) bool {
+	live, _, err := ns.nomadClient.Jobs().Info(*job.ID, ns.queryOptions())
+	if err != nil || live == nil {
+		return false
+	}
+	if live.Stop != nil && *live.Stop {
+		return false
+	}
+	return live.Meta["ns.hash"] == job.Meta["ns.hash"]
+}
+
+// jobID returns the id of the job last submitted from the source file
+func (ns *NomadSpace) jobID(fname string) string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.jobs[fname]
+}
+
+// recordJob remembers that the source file has been submitted as the job id
+func (ns *NomadSpace) recordJob(fname, id string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.jobs[fname] = id
+	ns.submitted[id] = true
+}
+
+// runJob submits the job from the source file, after its dependencies are
+// ready, and returns the evaluation id or an empty string if the job is
+// unchanged. The outcome is recorded in the source file status.
+func (ns *NomadSpace) runJob(ctx context.Context, l hclog.Logger, fname string, job *api.Job, env map[string]string) (evalID string, err error) {
+	ns.namespaceJob(job, fname, env)
+	// Periodic and parameterized jobs are submitted without evaluation, the
+	// job is only skipped if its hash matched
+	var unchanged bool
+	defer func() {
+		var outcome = SubmitSubmitted
+		if err != nil {
+			outcome = SubmitFailed
+		} else if unchanged {
+			outcome = SubmitUnchanged
+		}
+		jobSubmissions.WithLabelValues(ns.Id, *job.ID, outcome).Inc()
+		ns.updateStatus(fname, func(s *fileStatus) {
+			if err != nil {
+				s.LastError = err.Error()
+				return
+			}
+			s.LastError = ""
+			s.JobID = *job.ID
+			if !unchanged {
+				now := time.Now()
+				s.LastSubmit = &now
+				s.LastEval = evalID
+			}
+		})
+	}()
+	if ns.DependsWait != "none" {
+		for _, dep := range dependsOn(job) {
+			err := ns.waitDependency(ctx, l, fname, dep)
+			if err != nil {
+				l.Error("Dependency failed", "file", fname, "error", err)
+				return "", err
+			}
+		}
+	}
+	hash, err := jobHash(job)
 	if err != nil {
-		l.Printf("Submitted %v as %v: ERROR %v", fname, *job.ID, err)
-		return fmt.Errorf("failed to submit %v as %v, %v", fname, *job.ID, err)
+		return "", fmt.Errorf("failed to hash %v as %v, %v", fname, *job.ID, err)
+	}
+	job.Meta["ns.hash"] = hash
+	if ns.jobUnchanged(job) {
+		l.Info("Job unchanged", "file", fname, "job", *job.ID)
+		ns.recordJob(fname, *job.ID)
+		unchanged = true
+		return "", nil
+	}
+	if ns.Plan {
+		destructive, err := ns.plan(l, fname, job)
+		if err != nil {
+			return "", err
+		}
+		if destructive && ns.PlanDenyDestructive {
+			l.Error("Destructive updates denied", "file", fname, "job", *job.ID)
+			return "", fmt.Errorf("refusing to submit %v as %v, plan contains destructive updates", fname, *job.ID)
+		}
 	}
-	l.Printf("Submitted %v as %v: eval %v", fname, *job.ID, res.EvalID)
+	var res *api.JobRegisterResponse
+	err = ns.retryTransient(ctx, l, "Submitted "+fname+" as "+*job.ID, func() error {
+		var e error
+		res, _, e = ns.nomadClient.Jobs().Register(job, ns.writeOptions())
+		return e
+	})
+	if err != nil {
+		l.Error("Failed to submit job", "file", fname, "job", *job.ID, "error", err)
+		return "", fmt.Errorf("failed to submit %v as %v, %v", fname, *job.ID, err)
+	}
+	l.Info("Submitted job", "file", fname, "job", *job.ID, "eval", res.EvalID)
+	ns.recordJob(fname, *job.ID)
+	ns.mu.Lock()
+	ns.evals[*job.ID] = res.EvalID
+	delete(ns.states, *job.ID)
+	ns.mu.Unlock()
 	if len(res.Warnings) > 0 {
-		l.Printf("Submitted %v as %v: WARNING %v", fname, *job.ID, res.Warnings)
+		l.Warn("Job submitted with warnings", "file", fname, "job", *job.ID, "eval", res.EvalID, "warnings", res.Warnings)
 	}
-	return nil
+	return res.EvalID, nil
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestNamespaceService(t *testing.T) {
+	var space = &NomadSpace{Id: "abc"}
+	var service = &api.Service{
+		Name: "web",
+		Connect: &api.ConsulConnect{
+			SidecarService: &api.ConsulSidecarService{
+				Proxy: &api.ConsulProxy{
+					Upstreams: []*api.ConsulUpstream{{DestinationName: "db"}},
+				},
+			},
+			Gateway: &api.ConsulGateway{
+				Ingress: &api.ConsulIngressConfigEntry{
+					Listeners: []*api.ConsulIngressListener{{
+						Services: []*api.ConsulIngressService{{Name: "api"}, {Name: "*"}},
+					}},
+				},
+				Terminating: &api.ConsulTerminatingConfigEntry{
+					Services: []*api.ConsulLinkedService{{Name: "legacy"}},
+				},
+			},
+		},
+	}
+
+	space.namespaceService(service)
+
+	var names = []string{
+		service.Name,
+		service.Connect.SidecarService.Proxy.Upstreams[0].DestinationName,
+		service.Connect.Gateway.Ingress.Listeners[0].Services[0].Name,
+		service.Connect.Gateway.Ingress.Listeners[0].Services[1].Name,
+		service.Connect.Gateway.Terminating.Services[0].Name,
+	}
+	var expected = []string{"abc-web", "abc-db", "abc-api", "*", "abc-legacy"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("namespaceService: got %v, expected %v", names, expected)
+	}
+}
+
+func TestStuckFiles(t *testing.T) {
+	var space = &NomadSpace{Id: "abc", InputDir: "jobs", jobState: newJobState()}
+	space.setFileError("a.json", fmt.Errorf("submission failed"))
+	space.setFileBroken("b.json.tmpl", fmt.Errorf("template failed"))
+	space.setFileError("c.json", nil)
+
+	if stuck := space.stuckFiles(); !reflect.DeepEqual(stuck, []string{"a.json"}) {
+		t.Errorf("stuckFiles: got %v, expected [a.json]", stuck)
+	}
+	var expected = map[string]bool{"jobs/a.json": true, "jobs/b.json.tmpl": true}
+	if failed := space.failedSources(); !reflect.DeepEqual(failed, expected) {
+		t.Errorf("failedSources: got %v, expected %v", failed, expected)
+	}
+}
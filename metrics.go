@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of a job submission
+const (
+	SubmitSubmitted = "submitted"
+	SubmitUnchanged = "unchanged"
+	SubmitFailed    = "failed"
+)
+
+var (
+	jobSubmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nomadspace",
+		Name:      "job_submissions_total",
+		Help:      "Job submissions, by nomadspace, job and outcome (submitted, unchanged, failed).",
+	}, []string{"ns", "job", "outcome"})
+
+	templateRenders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nomadspace",
+		Name:      "template_renders_total",
+		Help:      "Templates rendered by consul-template, by nomadspace and template.",
+	}, []string{"ns", "template"})
+
+	templateMissingDeps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nomadspace",
+		Name:      "template_missing_deps",
+		Help:      "Dependencies a template is waiting for, by nomadspace and template.",
+	}, []string{"ns", "template"})
+
+	templateRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nomadspace",
+		Name:      "template_restarts_total",
+		Help:      "Restarts of consul-template after an error, by nomadspace.",
+	}, []string{"ns"})
+
+	filesStuck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nomadspace",
+		Name:      "stuck_files",
+		Help:      "Source files failing to be read or submitted, retried in partial mode, by nomadspace.",
+	}, []string{"ns"})
+)
+
+func init() {
+	prometheus.MustRegister(jobSubmissions, templateRenders, templateMissingDeps, templateRestarts, filesStuck)
+}
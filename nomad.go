@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// nomadOptions are the Nomad connection settings. Empty settings keep the
+// defaults from the NOMAD_* environment variables.
+type nomadOptions struct {
+	Addr           string
+	Token          string
+	TokenFile      string
+	TokenVaultPath string
+	CACert         string
+	ClientCert     string
+	ClientKey      string
+	Region         string
+	Namespace      string
+
+	tokenSecret *vaultapi.Secret // Vault secret of the token read from TokenVaultPath
+}
+
+// vaultTokenRetry is the delay before reading again a Nomad token from Vault
+// after a failure
+const vaultTokenRetry = 10 * time.Second
+
+// vaultToken reads a Nomad ACL token from the Vault Nomad secrets engine at
+// the given path, for example nomad/creds/deploy. It returns the token and
+// its secret holding the lease.
+func vaultToken(client *vaultapi.Client, path string) (string, *vaultapi.Secret, error) {
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return "", nil, err
+	} else if secret == nil {
+		return "", nil, fmt.Errorf("no secret at %v", path)
+	}
+	token, ok := secret.Data["secret_id"].(string)
+	if !ok {
+		return "", nil, fmt.Errorf("no secret_id in secret at %v", path)
+	}
+	return token, secret, nil
+}
+
+// watchLease renews the lease of a Vault secret until it cannot be renewed
+// any longer and should be read again. A lease that is not renewable is
+// waited for until two thirds of its duration.
+func watchLease(ctx context.Context, l hclog.Logger, vault *vaultapi.Client, secret *vaultapi.Secret) error {
+	if !secret.Renewable {
+		return sleep(ctx, time.Duration(secret.LeaseDuration)*time.Second*2/3)
+	}
+
+	renewer, err := vault.NewRenewer(&vaultapi.RenewerInput{Secret: secret})
+	if err != nil {
+		return err
+	}
+	go renewer.Renew()
+	defer renewer.Stop()
+
+	for {
+		select {
+		case err := <-renewer.DoneCh():
+			return err
+		case r := <-renewer.RenewCh():
+			l.Debug("Renewed Nomad token lease", "lease", r.Secret.LeaseDuration)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// renewToken keeps the Nomad token read from Vault valid: its lease is
+// renewed as long as possible, then a new token is read from Vault before
+// the lease expires and set on the Nomad client.
+func (o *nomadOptions) renewToken(ctx context.Context, l hclog.Logger, vault *vaultapi.Client, client *api.Client) {
+	var secret = o.tokenSecret
+	for secret != nil && secret.LeaseDuration > 0 {
+		err := watchLease(ctx, l, vault, secret)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			l.Warn("Failed to renew Nomad token lease", "path", o.TokenVaultPath, "error", err)
+		}
+
+		var token string
+		for {
+			token, secret, err = vaultToken(vault, o.TokenVaultPath)
+			if err == nil {
+				break
+			}
+			l.Error("Failed to read Nomad token from Vault", "path", o.TokenVaultPath, "error", err)
+			if sleep(ctx, vaultTokenRetry) != nil {
+				return
+			}
+		}
+		client.SetSecretID(token)
+		l.Info("Read new Nomad token from Vault", "path", o.TokenVaultPath, "lease", secret.LeaseDuration)
+	}
+}
+
+// config returns the Nomad API client configuration, the Vault client is
+// used to read the token from Vault
+func (o *nomadOptions) config(vault *vaultapi.Client) (*api.Config, error) {
+	var cfg = api.DefaultConfig()
+
+	if o.Addr != "" {
+		cfg.Address = o.Addr
+	}
+	if o.Region != "" {
+		cfg.Region = o.Region
+	}
+	if o.Namespace != "" {
+		cfg.Namespace = o.Namespace
+	}
+	if o.CACert != "" {
+		cfg.TLSConfig.CACert = o.CACert
+	}
+	if o.ClientCert != "" {
+		cfg.TLSConfig.ClientCert = o.ClientCert
+	}
+	if o.ClientKey != "" {
+		cfg.TLSConfig.ClientKey = o.ClientKey
+	}
+
+	var sources = 0
+	for _, s := range []string{o.Token, o.TokenFile, o.TokenVaultPath} {
+		if s != "" {
+			sources += 1
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("Cannot set more than one of --nomad-token, --nomad-token-file and --nomad-token-vault-path")
+	}
+
+	if o.Token != "" {
+		cfg.SecretID = o.Token
+	} else if o.TokenFile != "" {
+		data, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Nomad token, %v", err)
+		}
+		cfg.SecretID = strings.TrimSpace(string(data))
+	} else if o.TokenVaultPath != "" {
+		token, secret, err := vaultToken(vault, o.TokenVaultPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Nomad token from Vault, %v", err)
+		}
+		cfg.SecretID = token
+		o.tokenSecret = secret
+	}
+
+	return cfg, nil
+}
+
+// isPermissionDenied returns true if the Nomad API error is a 403 response
+func isPermissionDenied(err error) bool {
+	return strings.Contains(err.Error(), "403") || strings.Contains(err.Error(), "Permission denied")
+}
+
+// checkNomad checks that the Nomad agent is reachable and that the token
+// has the submit-job capability, by planning a job that is never submitted.
+// The plan fails with a permission error before the job is validated.
+func (ns *NomadSpace) checkNomad(l hclog.Logger, addr string) error {
+	leader, err := ns.nomadClient.Status().Leader()
+	if err != nil {
+		return fmt.Errorf("Nomad agent at %v unreachable, %v", addr, err)
+	}
+	l.Info("Nomad agent found", "address", addr, "leader", leader)
+
+	job := api.NewServiceJob(ns.prefix("submit-check"), "submit-check", "", 0)
+	job.AddTaskGroup(api.NewTaskGroup("check", 1).AddTask(api.NewTask("check", "raw_exec")))
+	_, _, err = ns.nomadClient.Jobs().Plan(job, false, ns.writeOptions())
+	if err != nil && isPermissionDenied(err) {
+		return fmt.Errorf("Nomad token lacks the submit-job capability, %v", err)
+	}
+
+	return nil
+}
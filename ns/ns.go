@@ -15,3 +15,23 @@ func Ns(data string) string {
 	sum := sha1.Sum([]byte(Salt + data))
 	return strings.ToLower(base36.EncodeBytes(sum[:])[0:8])
 }
+
+// Prefix returns the name prefixed with the nomadspace id, unless it is
+// already prefixed
+func Prefix(id, name string) string {
+	if !strings.HasPrefix(name, id+"-") {
+		name = id + "-" + name
+	}
+	return name
+}
+
+// Child returns the id of the child nomadspace run by a job or a
+// sub-directory (without the .nomad extension) of the nomadspace
+func Child(id, name string) string {
+	return Ns(Prefix(id, name))
+}
+
+// Service returns the Consul service name of a service of the nomadspace
+func Service(id, name string) string {
+	return Prefix(id, name)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+	"github.com/mildred/nomadspace/ns"
+)
+
+// spaceJobs are the jobs of a nomadspace found in Nomad
+type spaceJobs struct {
+	Id     string
+	Parent string
+	Owner  string
+	Depth  string
+	Jobs   []*api.Job
+}
+
+// space returns the nomadspace with the given id, sharing the Nomad client
+// and options
+func (ns *NomadSpace) space(id string) *NomadSpace {
+	var space = *ns
+	space.Id = id
+	space.jobState = newJobState()
+	return &space
+}
+
+// allJobs returns the jobs registered in Nomad that belong to a nomadspace,
+// that is jobs with the "ns" metadata. Every Nomad namespace is listed if
+// nomadspaces are Nomad namespaces.
+func (ns *NomadSpace) allJobs(includeStopped bool) ([]*api.Job, error) {
+	var namespaces = []string{""}
+	if ns.NomadNamespace {
+		list, _, err := ns.nomadClient.Namespaces().List(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Nomad namespaces, %v", err)
+		}
+		namespaces = nil
+		for _, namespace := range list {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+
+	var jobs []*api.Job
+	for _, namespace := range namespaces {
+		q := &api.QueryOptions{Namespace: namespace}
+		stubs, _, err := ns.nomadClient.Jobs().List(q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list jobs, %v", err)
+		}
+		for _, stub := range stubs {
+			if stub.Stop && !includeStopped {
+				continue
+			}
+			job, _, err := ns.nomadClient.Jobs().Info(stub.ID, q)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get job %v, %v", stub.ID, err)
+			}
+			if job.Meta["ns"] == "" {
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// groupSpaces groups the jobs by nomadspace id
+func groupSpaces(jobs []*api.Job) map[string]*spaceJobs {
+	var spaces = map[string]*spaceJobs{}
+	for _, job := range jobs {
+		id := job.Meta["ns"]
+		space, ok := spaces[id]
+		if !ok {
+			space = &spaceJobs{Id: id}
+			spaces[id] = space
+		}
+		if parent := job.Meta["ns.parent"]; parent != "" {
+			space.Parent = parent
+		}
+		if owner := job.Meta["ns.owner"]; owner != "" {
+			space.Owner = owner
+		}
+		if depth := job.Meta["ns.depth"]; depth != "" {
+			space.Depth = depth
+		}
+		space.Jobs = append(space.Jobs, job)
+	}
+	for _, space := range spaces {
+		sort.Slice(space.Jobs, func(i, j int) bool {
+			return *space.Jobs[i].ID < *space.Jobs[j].ID
+		})
+	}
+	return spaces
+}
+
+// spaceIds returns the sorted nomadspace ids
+func spaceIds(spaces map[string]*spaceJobs) []string {
+	var ids []string
+	for id := range spaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// descendants returns the id of the nomadspace followed by the ids of its
+// child nomadspaces, recursively
+func descendants(spaces map[string]*spaceJobs, id string) []string {
+	var res = []string{id}
+	for _, child := range spaceIds(spaces) {
+		if spaces[child].Parent == id && child != id {
+			res = append(res, descendants(spaces, child)...)
+		}
+	}
+	return res
+}
+
+// jobStatus returns the Nomad status of a job
+func jobStatus(job *api.Job) string {
+	if job.Status == nil {
+		return "unknown"
+	} else if job.Stop != nil && *job.Stop && *job.Status != "dead" {
+		return *job.Status + " (stopped)"
+	}
+	return *job.Status
+}
+
+// formatAllocSummary summarizes the allocations of task groups
+func formatAllocSummary(s *api.JobSummary) string {
+	var groups []string
+	for group := range s.Summary {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var res []string
+	for _, group := range groups {
+		g := s.Summary[group]
+		res = append(res, fmt.Sprintf("%s: %d running, %d starting, %d queued, %d failed, %d lost, %d complete",
+			group, g.Running, g.Starting, g.Queued, g.Failed, g.Lost, g.Complete))
+	}
+	return strings.Join(res, "; ")
+}
+
+// printIds prints the nomadspace ids of nomadspace jobs, like the ns plugin
+func printIds(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("Missing job name, usage: nomadspace id <job-name>...")
+	}
+	for _, name := range names {
+		fmt.Println(ns.Ns(name))
+	}
+	return nil
+}
+
+// runList prints the nomadspaces found in Nomad with their jobs
+func (ns *NomadSpace) runList() error {
+	jobs, err := ns.allJobs(true)
+	if err != nil {
+		return err
+	}
+
+	spaces := groupSpaces(jobs)
+	for _, id := range spaceIds(spaces) {
+		space := spaces[id]
+		if space.Parent != "" {
+			fmt.Printf("%v (parent %v)\n", id, space.Parent)
+		} else {
+			fmt.Println(id)
+		}
+		for _, job := range space.Jobs {
+			fmt.Printf("  %v: %v\n", *job.ID, jobStatus(job))
+		}
+	}
+
+	return nil
+}
+
+// runStatus prints the allocations and latest deployment of every job of
+// the nomadspace
+func (ns *NomadSpace) runStatus(id string) error {
+	space := ns.space(id)
+	jobs, err := space.listJobs(true)
+	if err != nil {
+		return err
+	} else if len(jobs) == 0 {
+		return fmt.Errorf("No job found in nomadspace %v", id)
+	}
+
+	for _, job := range jobs {
+		fmt.Printf("%v: %v\n", *job.ID, jobStatus(job))
+
+		summary, _, err := ns.nomadClient.Jobs().Summary(*job.ID, space.queryOptions())
+		if err != nil {
+			return fmt.Errorf("failed to get summary of job %v, %v", *job.ID, err)
+		}
+		fmt.Printf("  allocations: %v\n", formatAllocSummary(summary))
+
+		d, _, err := ns.nomadClient.Jobs().LatestDeployment(*job.ID, space.queryOptions())
+		if err != nil {
+			return fmt.Errorf("failed to get deployment of job %v, %v", *job.ID, err)
+		} else if d != nil {
+			fmt.Printf("  deployment:  %v %v (%v)\n", d.ID, d.Status, formatDeploymentState(d))
+		}
+	}
+
+	return nil
+}
+
+// runDestroy deregisters every job of the nomadspace and of its child
+// nomadspaces, purging them if requested
+func (ns *NomadSpace) runDestroy(l hclog.Logger, id string, purge bool) error {
+	jobs, err := ns.allJobs(purge)
+	if err != nil {
+		return err
+	}
+
+	spaces := groupSpaces(jobs)
+	var found bool
+	for _, spaceId := range descendants(spaces, id) {
+		space, ok := spaces[spaceId]
+		if !ok {
+			continue
+		}
+		found = true
+		var ids []string
+		for _, job := range space.Jobs {
+			ids = append(ids, *job.ID)
+		}
+		e := ns.space(spaceId).deregister(l, "Destroy "+spaceId, ids, purge)
+		if e != nil {
+			err = multierror.Append(err, e).ErrorOrNil()
+		}
+	}
+	if !found {
+		return fmt.Errorf("No job found in nomadspace %v", id)
+	}
+
+	return err
+}
+
+// treeNode is a nomadspace or a job in the nomadspace hierarchy
+type treeNode struct {
+	label    string
+	children []*treeNode
+}
+
+// spaceLabel describes a nomadspace in the hierarchy
+func spaceLabel(space *spaceJobs) string {
+	var desc []string
+	if space.Depth != "" {
+		desc = append(desc, "depth "+space.Depth)
+	}
+	if space.Owner != "" {
+		desc = append(desc, "owner "+space.Owner)
+	}
+	if len(desc) == 0 {
+		return space.Id
+	}
+	return fmt.Sprintf("%v (%v)", space.Id, strings.Join(desc, ", "))
+}
+
+// jobLabel describes a job in the hierarchy
+func jobLabel(job *api.Job) string {
+	if source := job.Meta["ns.source"]; source != "" {
+		return fmt.Sprintf("%v: %v (%v)", *job.ID, jobStatus(job), source)
+	}
+	return fmt.Sprintf("%v: %v", *job.ID, jobStatus(job))
+}
+
+// buildTree rebuilds the nomadspace hierarchy and returns its roots. Jobs are
+// placed under their nomadspace. A child nomadspace is placed under the job
+// that runs it, found from the owner and parent metadata, or else under its
+// parent nomadspace if it is run by the same process.
+func buildTree(spaces map[string]*spaceJobs) []*treeNode {
+	var nodes = map[string]*treeNode{}    // nomadspace id -> node
+	var jobNodes = map[string]*treeNode{} // nomadspace id and job name -> node
+	var roots []*treeNode
+
+	for _, id := range spaceIds(spaces) {
+		space := spaces[id]
+		nodes[id] = &treeNode{label: spaceLabel(space)}
+		for _, job := range space.Jobs {
+			n := &treeNode{label: jobLabel(job)}
+			nodes[id].children = append(nodes[id].children, n)
+			// The owner is NOMAD_JOB_NAME, the job name
+			name := *job.ID
+			if job.Name != nil && *job.Name != "" {
+				name = *job.Name
+			}
+			jobNodes[id+"/"+name] = n
+		}
+	}
+
+	for _, id := range spaceIds(spaces) {
+		space := spaces[id]
+		if space.Parent == "" {
+			roots = append(roots, nodes[id])
+			continue
+		}
+		if n, ok := jobNodes[space.Parent+"/"+space.Owner]; ok {
+			n.children = append(n.children, nodes[id])
+			continue
+		}
+		parent, ok := nodes[space.Parent]
+		if !ok {
+			parent = &treeNode{label: space.Parent + " (no job)"}
+			nodes[space.Parent] = parent
+			roots = append(roots, parent)
+		}
+		parent.children = append(parent.children, nodes[id])
+	}
+
+	return roots
+}
+
+// printTree prints the nodes of the hierarchy with their children
+func printTree(nodes []*treeNode, indent string) {
+	for i, n := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Println(indent + branch + n.label)
+		printTree(n.children, indent+next)
+	}
+}
+
+// runTree prints the hierarchy of the nomadspaces found in Nomad, rebuilt
+// from the job metadata
+func (ns *NomadSpace) runTree() error {
+	jobs, err := ns.allJobs(true)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range buildTree(groupSpaces(jobs)) {
+		fmt.Println(root.label)
+		printTree(root.children, "")
+	}
+
+	return nil
+}
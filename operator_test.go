@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func treeJob(id, name string, meta map[string]string) *api.Job {
+	var status = "running"
+	var job = &api.Job{ID: &id, Status: &status, Meta: meta}
+	if name != "" {
+		job.Name = &name
+	}
+	return job
+}
+
+// treeString returns the labels of the tree nodes indented by depth
+func treeString(nodes []*treeNode, indent string) string {
+	var res string
+	for _, n := range nodes {
+		res += indent + n.label + "\n" + treeString(n.children, indent+"  ")
+	}
+	return res
+}
+
+func TestBuildTree(t *testing.T) {
+	var tests = []struct {
+		name string
+		jobs []*api.Job
+		tree string
+	}{
+		{
+			name: "nested nomadspace under its prefixed owner job",
+			jobs: []*api.Job{
+				treeJob("aaa-web", "aaa-web", map[string]string{"ns": "aaa"}),
+				treeJob("aaa-nested", "aaa-nested", map[string]string{"ns": "aaa"}),
+				treeJob("bbb-db", "bbb-db", map[string]string{"ns": "bbb", "ns.parent": "aaa", "ns.owner": "aaa-nested"}),
+			},
+			tree: `
+aaa
+  aaa-nested: running
+    bbb (owner aaa-nested)
+      bbb-db: running
+  aaa-web: running
+`,
+		},
+		{
+			name: "owner job name without the prefix of its id",
+			jobs: []*api.Job{
+				treeJob("aaa-nested", "nested", map[string]string{"ns": "aaa"}),
+				treeJob("bbb-db", "", map[string]string{"ns": "bbb", "ns.parent": "aaa", "ns.owner": "nested"}),
+			},
+			tree: `
+aaa
+  aaa-nested: running
+    bbb (owner nested)
+      bbb-db: running
+`,
+		},
+		{
+			name: "sub-directory nomadspace under its parent",
+			jobs: []*api.Job{
+				treeJob("aaa-web", "aaa-web", map[string]string{"ns": "aaa", "ns.owner": "ns-root", "ns.depth": "0"}),
+				treeJob("ccc-x", "ccc-x", map[string]string{"ns": "ccc", "ns.parent": "aaa", "ns.owner": "ns-root", "ns.depth": "1"}),
+			},
+			tree: `
+aaa (depth 0, owner ns-root)
+  aaa-web: running
+  ccc (depth 1, owner ns-root)
+    ccc-x: running
+`,
+		},
+		{
+			name: "parent without jobs",
+			jobs: []*api.Job{
+				treeJob("ddd-y", "ddd-y", map[string]string{"ns": "ddd", "ns.parent": "zzz", "ns.source": "/jobs/y.json"}),
+			},
+			tree: `
+zzz (no job)
+  ddd
+    ddd-y: running (/jobs/y.json)
+`,
+		},
+	}
+	for _, test := range tests {
+		tree := treeString(buildTree(groupSpaces(test.jobs)), "")
+		if tree != strings.TrimPrefix(test.tree, "\n") {
+			t.Errorf("%s: tree\n%s\nexpected\n%s", test.name, tree, test.tree)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+func diffMarker(diffType string) string {
+	switch diffType {
+	case "Added":
+		return "+"
+	case "Deleted":
+		return "-"
+	case "Edited":
+		return "+/-"
+	default:
+		return ""
+	}
+}
+
+func formatFieldDiff(b *strings.Builder, indent string, f *api.FieldDiff) {
+	if f.Type == "None" {
+		return
+	}
+	fmt.Fprintf(b, "%s%s %s: ", indent, diffMarker(f.Type), f.Name)
+	switch f.Type {
+	case "Added":
+		fmt.Fprintf(b, "%q", f.New)
+	case "Deleted":
+		fmt.Fprintf(b, "%q", f.Old)
+	default:
+		fmt.Fprintf(b, "%q => %q", f.Old, f.New)
+	}
+	if len(f.Annotations) > 0 {
+		fmt.Fprintf(b, " (%s)", strings.Join(f.Annotations, ", "))
+	}
+	b.WriteString("\n")
+}
+
+func formatObjectDiff(b *strings.Builder, indent string, o *api.ObjectDiff) {
+	if o.Type == "None" {
+		return
+	}
+	fmt.Fprintf(b, "%s%s %s {\n", indent, diffMarker(o.Type), o.Name)
+	for _, f := range o.Fields {
+		formatFieldDiff(b, indent+"  ", f)
+	}
+	for _, obj := range o.Objects {
+		formatObjectDiff(b, indent+"  ", obj)
+	}
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+// formatJobDiff returns a human readable representation of a job diff,
+// similar to the output of nomad plan.
+func formatJobDiff(d *api.JobDiff) string {
+	var b strings.Builder
+	if d == nil {
+		return ""
+	}
+	fmt.Fprintf(&b, "%s Job: %q\n", diffMarker(d.Type), d.ID)
+	for _, f := range d.Fields {
+		formatFieldDiff(&b, "  ", f)
+	}
+	for _, o := range d.Objects {
+		formatObjectDiff(&b, "  ", o)
+	}
+	for _, tg := range d.TaskGroups {
+		if tg.Type == "None" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s Task Group: %q\n", diffMarker(tg.Type), tg.Name)
+		for _, f := range tg.Fields {
+			formatFieldDiff(&b, "    ", f)
+		}
+		for _, o := range tg.Objects {
+			formatObjectDiff(&b, "    ", o)
+		}
+		for _, t := range tg.Tasks {
+			if t.Type == "None" {
+				continue
+			}
+			fmt.Fprintf(&b, "  %s Task: %q", diffMarker(t.Type), t.Name)
+			if len(t.Annotations) > 0 {
+				fmt.Fprintf(&b, " (%s)", strings.Join(t.Annotations, ", "))
+			}
+			b.WriteString("\n")
+			for _, f := range t.Fields {
+				formatFieldDiff(&b, "      ", f)
+			}
+			for _, o := range t.Objects {
+				formatObjectDiff(&b, "      ", o)
+			}
+		}
+	}
+	return b.String()
+}
+
+// formatDesiredUpdates returns a summary of the scheduler annotations for a
+// task group, for example "1 create, 2 in-place update".
+func formatDesiredUpdates(u *api.DesiredUpdates) string {
+	var counts []string
+	for _, c := range []struct {
+		n    uint64
+		name string
+	}{
+		{u.Place, "create"},
+		{u.Stop, "destroy"},
+		{u.Migrate, "migrate"},
+		{u.InPlaceUpdate, "in-place update"},
+		{u.DestructiveUpdate, "create/destroy update"},
+		{u.Canary, "canary"},
+		{u.Preemptions, "preemption"},
+		{u.Ignore, "ignore"},
+	} {
+		if c.n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", c.n, c.name))
+		}
+	}
+	return strings.Join(counts, ", ")
+}
+
+// plan runs a Nomad plan for the job and logs the diff and the scheduler
+// annotations. It returns true if the plan contains destructive updates.
+func (ns *NomadSpace) plan(l hclog.Logger, fname string, job *api.Job) (bool, error) {
+	res, _, err := ns.nomadClient.Jobs().Plan(job, true, ns.writeOptions())
+	if err != nil {
+		l.Error("Plan failed", "file", fname, "job", *job.ID, "error", err)
+		return false, fmt.Errorf("failed to plan %v as %v, %v", fname, *job.ID, err)
+	}
+
+	l.Info("Plan", "file", fname, "job", *job.ID, "diff", formatJobDiff(res.Diff))
+
+	var destructive = false
+	if res.Annotations != nil {
+		var groups []string
+		for group := range res.Annotations.DesiredTGUpdates {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			u := res.Annotations.DesiredTGUpdates[group]
+			l.Info("Plan task group", "file", fname, "job", *job.ID, "group", group, "updates", formatDesiredUpdates(u))
+			if u.DestructiveUpdate > 0 || u.Stop > 0 {
+				destructive = true
+			}
+		}
+	}
+	for group, metric := range res.FailedTGAllocs {
+		l.Warn("Plan task group failed to place allocations", "file", fname, "job", *job.ID, "group", group, "allocations", metric.CoalescedFailures+1)
+	}
+	if res.Warnings != "" {
+		l.Warn("Plan warnings", "file", fname, "job", *job.ID, "warnings", res.Warnings)
+	}
+
+	return destructive, nil
+}
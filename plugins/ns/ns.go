@@ -8,25 +8,55 @@ import (
 	"github.com/mildred/nomadspace/ns"
 )
 
+// lookup returns the first non empty environment variable
+func lookup(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
 func main() {
+	var prefix, parent bool
+	var child, service string
+	flag.BoolVar(&prefix, "prefix", false, "Print the current nomadspace prefix")
+	flag.BoolVar(&parent, "parent", false, "Print the parent nomadspace id")
+	flag.StringVar(&child, "child", "", "Print the child nomadspace id for the job")
+	flag.StringVar(&service, "service", "", "Print the prefixed service name")
 	flag.Parse()
 
-	if len(flag.Args()) == 0 {
-		ns := os.Getenv("env.meta.ns")
-		if ns == "" {
-			ns = os.Getenv("NOMADSPACE_ID")
-		}
-		if ns == "" {
-			os.Exit(1)
-		} else {
-			fmt.Println(os.Getenv("env.meta.ns"))
-		}
-	} else {
+	id := lookup("env.meta.ns", "NOMAD_META_ns", "NOMAD_META_NS", "NOMADSPACE_ID")
+
+	if len(flag.Args()) > 0 {
 		for i, arg := range flag.Args() {
 			if i > 0 {
 				fmt.Print("\n")
 			}
 			fmt.Print(ns.Ns(arg))
 		}
+		return
+	}
+
+	if parent {
+		fmt.Print(lookup("env.meta.ns.parent", "NOMAD_META_ns_parent", "NOMAD_META_NS_PARENT", "NOMADSPACE_PARENT"))
+		return
+	}
+
+	if id == "" {
+		fmt.Fprintln(os.Stderr, "No nomadspace id in the environment")
+		os.Exit(1)
+	}
+
+	switch {
+	case prefix:
+		fmt.Print(id + "-")
+	case child != "":
+		fmt.Print(ns.Child(id, child))
+	case service != "":
+		fmt.Print(ns.Service(id, service))
+	default:
+		fmt.Print(id)
 	}
 }
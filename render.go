@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/manager"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+)
+
+// renderedTemplate is the result of rendering a template once
+type renderedTemplate struct {
+	contents    []byte
+	missingDeps []string
+	env         map[string]string
+}
+
+// renderOnce renders the group templates once and returns them by source
+// file name. Templates that could not be rendered before the timeout are
+// returned without contents, with their missing dependencies.
+func (ns *NomadSpace) renderOnce(ctx context.Context, l hclog.Logger, group *templateGroup, timeout time.Duration) (map[string]*renderedTemplate, error) {
+	cfg := group.cfg.Copy()
+	cfg.Once = true
+
+	runner, err := manager.NewRunner(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	runner.Env = ns.templateEnv(group.env)
+	if !ns.VerboseCT {
+		runner.SetOutStream(ioutil.Discard)
+		runner.SetErrStream(ioutil.Discard)
+	}
+
+	go runner.Start()
+	defer runner.Stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-runner.DoneCh:
+	case err = <-runner.ErrCh:
+		return nil, err
+	case <-timer.C:
+		l.Warn("Template rendering timed out", "timeout", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var res = map[string]*renderedTemplate{}
+	for _, templ := range *group.cfg.Templates {
+		res[path.Base(*templ.Source)] = &renderedTemplate{env: group.env}
+	}
+	for _, event := range runner.RenderEvents() {
+		r := res[path.Base(*event.TemplateConfigs[0].Source)]
+		if r == nil {
+			continue
+		}
+		if event.MissingDeps != nil {
+			for _, dep := range event.MissingDeps.List() {
+				r.missingDeps = append(r.missingDeps, dep.String())
+			}
+		}
+		if len(r.missingDeps) == 0 && event.WouldRender {
+			r.contents = event.Contents
+		}
+	}
+
+	return res, nil
+}
+
+// renderInput renders once the templates read from an input directory, with
+// the child nomadspace ids in their environment. It returns the rendered
+// templates by source file name and the errors of the template groups that
+// could not be rendered.
+func (ns *NomadSpace) renderInput(ctx context.Context, l hclog.Logger, in *inputFiles, timeout time.Duration) (map[string]*renderedTemplate, []string) {
+	var childEnv = map[string]string{}
+	for dir := range in.dirs {
+		childEnv[childEnvName(dir)] = newChild(ns, dir, nil).Id
+	}
+
+	var res = map[string]*renderedTemplate{}
+	var problems []string
+	for _, group := range in.groups {
+		if len(*group.cfg.Templates) == 0 {
+			continue
+		}
+		group.env = copyEnv(group.env)
+		for k, v := range childEnv {
+			group.env[k] = v
+		}
+		rendered, err := ns.renderOnce(ctx, l, group, timeout)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for fname, r := range rendered {
+			res[fname] = r
+		}
+	}
+
+	return res, problems
+}
+
+// render renders the templates of the input directory and its child
+// nomadspaces once to the output directory, as rendered and as submitted
+// after the job modifications in JSON. It returns the problems found
+// prefixed with the file they are found in.
+func (ns *NomadSpace) render(ctx context.Context, l hclog.Logger, inputDir, outputDir string, timeout time.Duration) ([]string, error) {
+	var problems []string
+	var report = func(fname string, msg string) {
+		problems = append(problems, fmt.Sprintf("%v: %v", path.Join(inputDir, fname), msg))
+	}
+
+	in, err := ns.readInputDir(l, inputDir)
+	if in == nil {
+		return nil, err
+	} else if err != nil {
+		for _, e := range err.(*multierror.Error).Errors {
+			problems = append(problems, e.Error())
+		}
+	}
+
+	err = os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, res := ns.renderInput(ctx, l, in, timeout)
+	problems = append(problems, res...)
+
+	var fnames []string
+	for fname := range rendered {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+
+	for _, fname := range fnames {
+		r := rendered[fname]
+		if r.contents == nil {
+			report(fname, fmt.Sprintf("not rendered, missing dependencies: %v", strings.Join(r.missingDeps, ", ")))
+			continue
+		}
+
+		dst := path.Join(outputDir, strings.TrimSuffix(fname, ".tmpl"))
+		err = ioutil.WriteFile(dst, r.contents, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("Rendered", "file", path.Join(inputDir, fname), "dest", dst)
+
+		if !strings.HasSuffix(fname, ".json.tmpl") && !strings.HasSuffix(fname, ".nomad.tmpl") {
+			continue
+		} else if strings.HasSuffix(fname, ".nomad.tmpl") && ns.offline {
+			l.Warn("Skip parsing rendered .nomad file, .nomad files are parsed by the Nomad agent", "file", path.Join(inputDir, fname))
+			continue
+		}
+		job, err := ns.parseRendered(fname, r.contents)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		} else if job.ID == nil || *job.ID == "" {
+			report(fname, "job has no id")
+			continue
+		}
+		ns.namespaceJob(job, fname, r.env)
+		data, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(dst+".namespaced.json", append(data, '\n'), 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.Info("Rendered as submitted", "file", path.Join(inputDir, fname), "dest", dst+".namespaced.json")
+	}
+
+	var dirs []string
+	for dir := range in.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		child := newChild(ns, dir, in.dirs[dir])
+		err := os.MkdirAll(child.RenderedDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		res, err := child.render(ctx, l, path.Join(inputDir, dir), path.Join(outputDir, dir), timeout)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, res...)
+	}
+
+	return problems, nil
+}
+
+// runRender renders the templates of the input directory with the Consul
+// and Vault data of the fixtures file and prints the problems found
+func (ns *NomadSpace) runRender(ctx context.Context, l hclog.Logger, inputDir, fixturesFile, outputDir string, timeout time.Duration) error {
+	f, err := readFixtures(fixturesFile)
+	if err != nil {
+		return err
+	}
+
+	env, err := f.env()
+	if err != nil {
+		return err
+	}
+	ns.Env = copyEnv(ns.Env)
+	for k, v := range env {
+		ns.Env[k] = v
+	}
+
+	consul, vault, stop, err := f.serve(l)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	ns.TemplateConfig = ns.templateConfig()
+	consul.Retry = ns.TemplateConfig.Consul.Retry
+	vault.Retry = ns.TemplateConfig.Vault.Retry
+	ns.TemplateConfig.Consul = consul
+	ns.TemplateConfig.Vault = vault
+
+	if _, err := ns.nomadClient.Status().Leader(); err != nil {
+		ns.offline = true
+		l.Warn("Nomad agent unreachable, rendered .nomad.tmpl files are not parsed", "error", err)
+	}
+
+	problems, err := ns.render(ctx, l, inputDir, outputDir, timeout)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %v", len(problems), inputDir)
+	}
+
+	return nil
+}
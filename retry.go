@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+// transientStatus matches the Nomad API errors with a status code worth
+// retrying: too many requests and server errors
+var transientStatus = regexp.MustCompile(`Unexpected response code: (429|5[0-9][0-9])\b`)
+
+// isTransient returns true if the Nomad API error may succeed when retried:
+// network errors, rate limiting and server errors
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	} else if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return transientStatus.MatchString(err.Error())
+}
+
+// retryBackoff returns the delay before the given retry attempt, starting at
+// 1, doubled after each attempt up to the maximum backoff
+func (ns *NomadSpace) retryBackoff(attempt int) time.Duration {
+	var delay = ns.SubmitRetryBackoff
+	for i := 1; i < attempt && delay < ns.SubmitRetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > ns.SubmitRetryMaxBackoff {
+		delay = ns.SubmitRetryMaxBackoff
+	}
+	return delay
+}
+
+// sleep waits for the given delay, or returns the context error if the
+// context is cancelled before
+func sleep(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryTransient calls f until it succeeds, returns an error that is not
+// transient or the retry attempts are exhausted
+func (ns *NomadSpace) retryTransient(ctx context.Context, l hclog.Logger, desc string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !isTransient(err) || attempt > ns.SubmitRetryAttempts {
+			return err
+		}
+		delay := ns.retryBackoff(attempt)
+		l.Warn(desc+": transient error, retrying", "error", err, "attempt", attempt, "attempts", ns.SubmitRetryAttempts, "delay", delay)
+		if e := sleep(ctx, delay); e != nil {
+			return err
+		}
+	}
+}
+
+// setRetry records in the status of the stuck files the number of attempts
+// and the time of the next retry, and updates the stuck files metric
+func (ns *NomadSpace) setRetry(names []string, attempt int, next time.Time) {
+	for _, name := range names {
+		ns.updateStatus(name, func(s *fileStatus) {
+			s.Attempts = attempt
+			s.NextRetry = &next
+		})
+	}
+	filesStuck.WithLabelValues(ns.Id).Set(float64(len(ns.stuckFiles())))
+}
+
+// pendingNames returns the sorted names of the rendered templates failing to
+// submit
+func pendingNames(pending map[string][]byte) []string {
+	var fnames []string
+	for fname := range pending {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	return fnames
+}
+
+// resubmitFile reads again a source file of the input directory and submits
+// it, or writes its Consul keys
+func (ns *NomadSpace) resubmitFile(ctx context.Context, l hclog.Logger, inputDir, name string, dirEnv map[string]string) error {
+	fname := path.Join(inputDir, name)
+	env, err := ns.readJobEnv(l, inputDir, name, dirEnv)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(name, ".keys") {
+		keys, err := readKeys(fname)
+		if err != nil {
+			return err
+		}
+		return ns.writeKeys(l, name, keys)
+	}
+
+	var job *api.Job
+	if strings.HasSuffix(name, ".json") {
+		job, err = readJSON(fname)
+	} else if strings.HasSuffix(name, ".nomad") {
+		job, err = readNomadAPI(ns.nomadClient, fname)
+	} else {
+		return fmt.Errorf("cannot submit %v", fname)
+	}
+	if err != nil {
+		return err
+	}
+
+	evalID, err := ns.runJob(ctx, l, name, job, env)
+	if err == nil && evalID != "" && ns.Wait {
+		go ns.waitBackground(ctx, l, name, *job.ID, evalID)
+	}
+	return err
+}
+
+// retryFiles reads and submits again the stuck source files with an
+// exponential backoff, until they are all submitted or the context is
+// cancelled. The nomadspace is then ready if the job templates are
+// submitted too.
+func (ns *NomadSpace) retryFiles(ctx context.Context, l hclog.Logger, inputDir string, names []string, dirEnv map[string]string, jobTemplates []string) {
+	for attempt := 1; len(names) > 0; attempt++ {
+		delay := ns.retryBackoff(attempt)
+		ns.setRetry(names, attempt, time.Now().Add(delay))
+		l.Warn("Stuck files", "files", strings.Join(names, ", "), "attempt", attempt, "delay", delay)
+		if sleep(ctx, delay) != nil {
+			return
+		}
+
+		var stuck []string
+		for _, name := range names {
+			err := ns.resubmitFile(ctx, l, inputDir, name, dirEnv)
+			ns.setFileError(name, err)
+			if err != nil {
+				l.Error("Retry failed", "file", name, "error", err)
+				stuck = append(stuck, name)
+			}
+		}
+		names = stuck
+	}
+
+	ns.setRetry(nil, 0, time.Time{})
+	l.Info("Stuck files submitted")
+	ns.checkReady(l, jobTemplates)
+}
+
+// checkReady marks the nomadspace ready and garbage collects orphan jobs
+// once the job templates are submitted and no source file is stuck
+func (ns *NomadSpace) checkReady(l hclog.Logger, jobTemplates []string) {
+	if !ns.hasAllJobs(jobTemplates) || len(ns.stuckFiles()) > 0 {
+		return
+	}
+	ns.setReady(l)
+	if ns.GC {
+		if e := ns.gc(l); e != nil {
+			l.Error("GC failed", "error", e)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// fileStatus is the submission status of a source file of the input directory
+type fileStatus struct {
+	File        string     `json:"file"`
+	JobID       string     `json:"job_id,omitempty"`
+	LastSubmit  *time.Time `json:"last_submit,omitempty"`
+	LastEval    string     `json:"last_eval,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	State       string     `json:"state,omitempty"`
+	MissingDeps []string   `json:"missing_deps,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+	Broken      bool       `json:"broken,omitempty"` // not retried until the file changes
+}
+
+// spaceStatus is the status of a nomadspace, as served on /v1/status
+type spaceStatus struct {
+	Id       string                  `json:"id"`
+	Parent   string                  `json:"parent,omitempty"`
+	InputDir string                  `json:"input_dir"`
+	Ready    bool                    `json:"ready"`
+	Stuck    []string                `json:"stuck,omitempty"`
+	Files    []*fileStatus           `json:"files"`
+	Children map[string]*spaceStatus `json:"children,omitempty"`
+}
+
+// setStatusFiles sets the source files of the input directory, forgetting
+// the status of files that are no longer present.
+func (ns *NomadSpace) setStatusFiles(inputDir string, sources []string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.inputDir = inputDir
+	var files = map[string]*fileStatus{}
+	for _, fname := range sources {
+		if s, ok := ns.files[fname]; ok {
+			files[fname] = s
+		} else {
+			files[fname] = &fileStatus{File: fname}
+		}
+	}
+	ns.files = files
+}
+
+// updateStatus modifies the status of a source file
+func (ns *NomadSpace) updateStatus(fname string, update func(s *fileStatus)) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	s, ok := ns.files[fname]
+	if !ok {
+		s = &fileStatus{File: fname}
+		ns.files[fname] = s
+	}
+	update(s)
+}
+
+// setFileError records the last error of a source file, or clears it
+func (ns *NomadSpace) setFileError(fname string, err error) {
+	ns.updateStatus(fname, func(s *fileStatus) {
+		s.Broken = false
+		if err != nil {
+			s.LastError = err.Error()
+		} else {
+			s.LastError = ""
+			s.Attempts = 0
+			s.NextRetry = nil
+		}
+	})
+}
+
+// setFileBroken records the error of a source file that is not retried and
+// stays broken until the input directory changes
+func (ns *NomadSpace) setFileBroken(fname string, err error) {
+	ns.updateStatus(fname, func(s *fileStatus) {
+		s.LastError = err.Error()
+		s.Broken = true
+		s.Attempts = 0
+		s.NextRetry = nil
+	})
+}
+
+// stuckFiles returns the source files whose last read or submission failed
+// and that are retried
+func (ns *NomadSpace) stuckFiles() []string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	var names []string
+	for fname, s := range ns.files {
+		if s.LastError != "" && !s.Broken {
+			names = append(names, fname)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failedSources returns the paths of the source files in error, as found in
+// the "ns.source" job metadata
+func (ns *NomadSpace) failedSources() map[string]bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	var res = map[string]bool{}
+	for fname, s := range ns.files {
+		if s.LastError != "" {
+			res[path.Join(ns.InputDir, fname)] = true
+		}
+	}
+	return res
+}
+
+// setReady marks the nomadspace ready once the initial submission succeeded
+func (ns *NomadSpace) setReady(l hclog.Logger) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if !ns.ready {
+		l.Info("NomadSpace is ready", "nomadspace", ns.Id)
+	}
+	ns.ready = true
+}
+
+// isReady returns true if the nomadspace and all its children are ready
+func (ns *NomadSpace) isReady() bool {
+	ns.mu.Lock()
+	var ready = ns.ready
+	var children []*NomadSpace
+	for _, c := range ns.children {
+		children = append(children, c.ns)
+	}
+	ns.mu.Unlock()
+
+	for _, child := range children {
+		ready = ready && child.isReady()
+	}
+	return ready
+}
+
+// status returns the status of the nomadspace and its children
+func (ns *NomadSpace) status() *spaceStatus {
+	ns.mu.Lock()
+	var res = &spaceStatus{
+		Id:       ns.Id,
+		Parent:   ns.Parent,
+		InputDir: ns.inputDir,
+		Ready:    ns.ready,
+		Files:    []*fileStatus{},
+	}
+	for _, s := range ns.files {
+		var file = *s
+		file.State = ns.states[file.JobID]
+		res.Files = append(res.Files, &file)
+	}
+	var children = map[string]*NomadSpace{}
+	for dir, c := range ns.children {
+		children[dir] = c.ns
+	}
+	ns.mu.Unlock()
+
+	res.Stuck = ns.stuckFiles()
+	sort.Slice(res.Files, func(i, j int) bool {
+		return res.Files[i].File < res.Files[j].File
+	})
+
+	if len(children) > 0 {
+		res.Children = map[string]*spaceStatus{}
+		for dir, child := range children {
+			res.Children[dir] = child.status()
+		}
+	}
+
+	return res
+}
+
+// serveHTTP serves the health check on /healthz, the nomadspace status on
+// /v1/status and the Prometheus metrics on /metrics until the context is
+// cancelled.
+func (ns *NomadSpace) serveHTTP(ctx context.Context, l hclog.Logger, listen string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !ns.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(ns.status())
+	})
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	l.Info("HTTP server listening", "address", listen)
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
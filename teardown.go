@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+)
+
+// waitEval blocks until the evaluation reaches a terminal status or the
+// context is done.
+func (ns *NomadSpace) waitEval(ctx context.Context, evalID string) (*api.Evaluation, error) {
+	var index uint64
+	for {
+		q := ns.queryOptions()
+		q.WaitIndex = index
+		q.WaitTime = time.Second
+		eval, meta, err := ns.nomadClient.Evaluations().Info(evalID, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get evaluation %v, %v", evalID, err)
+		}
+		switch eval.Status {
+		case "complete", "failed", "canceled":
+			return eval, nil
+		}
+		index = meta.LastIndex
+		select {
+		case <-ctx.Done():
+			return eval, fmt.Errorf("evaluation %v is still %v, %v", evalID, eval.Status, ctx.Err())
+		default:
+		}
+	}
+}
+
+// deregister deregisters the jobs of the nomadspace, purging them if
+// requested, and waits for the resulting evaluations. Messages are logged
+// with the given description.
+func (ns *NomadSpace) deregister(l hclog.Logger, desc string, ids []string, purge bool) error {
+	var err error
+
+	l.Info(desc+": deregister jobs", "jobs", len(ids))
+
+	var evals = map[string]string{}
+	for _, id := range ids {
+		evalID, _, e := ns.nomadClient.Jobs().Deregister(id, purge, ns.writeOptions())
+		if e != nil {
+			l.Error(desc+": failed to deregister job", "job", id, "error", e)
+			err = multierror.Append(err, fmt.Errorf("failed to deregister %v, %v", id, e)).ErrorOrNil()
+			continue
+		}
+		l.Info(desc+": deregistered job", "job", id, "eval", evalID)
+		evals[id] = evalID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ns.TeardownTimeout)
+	defer cancel()
+
+	for _, id := range ids {
+		evalID, ok := evals[id]
+		if !ok {
+			continue
+		}
+		eval, e := ns.waitEval(ctx, evalID)
+		if e != nil {
+			l.Error(desc+": failed to deregister job", "job", id, "eval", evalID, "error", e)
+			err = multierror.Append(err, e).ErrorOrNil()
+			continue
+		}
+		l.Info(desc+": deregistered job", "job", id, "eval", evalID, "status", eval.Status)
+	}
+
+	return err
+}
+
+// teardown deregisters every job submitted by the nomadspace, waits for the
+// resulting evaluations and deletes the Consul keys written from .keys
+// files.
+func (ns *NomadSpace) teardown(l hclog.Logger) error {
+	var ids []string
+
+	ns.mu.Lock()
+	for id := range ns.submitted {
+		ids = append(ids, id)
+	}
+	ns.mu.Unlock()
+
+	sort.Strings(ids)
+
+	err := ns.deregister(l, "Teardown", ids, false)
+
+	if e := ns.deleteKeys(l); e != nil {
+		err = multierror.Append(err, e).ErrorOrNil()
+	}
+
+	return err
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mildred/nomadspace/ns"
+)
+
+// templateHelperArgs lists the nomadspace template helpers and whether they
+// take a string argument: never, optionally or always.
+var templateHelperArgs = map[string]string{
+	"ns":        "optional",
+	"nsPrefix":  "never",
+	"parentNs":  "never",
+	"childNs":   "always",
+	"nsService": "always",
+}
+
+// templateHelperIdent matches a template helper name in the code of a
+// template action, not part of a field, variable or longer identifier
+var templateHelperIdent = regexp.MustCompile(`(^|[^\w.$])(ns|nsPrefix|parentNs|childNs|nsService)\b`)
+
+// templateHelper returns the value of a template helper for the nomadspace.
+// The argument is nil if the helper is called without argument.
+func templateHelper(space *NomadSpace, name string, arg *string) (string, bool) {
+	switch {
+	case name == "ns" && arg == nil:
+		return space.Id, true
+	case name == "ns":
+		return ns.Ns(*arg), true
+	case name == "nsPrefix":
+		return space.Id + "-", true
+	case name == "parentNs":
+		return space.Parent, true
+	case name == "childNs" && arg != nil:
+		return ns.Child(space.Id, *arg), true
+	case name == "nsService" && arg != nil:
+		if !space.PrefixServices {
+			return *arg, true
+		}
+		return ns.Service(space.Id, *arg), true
+	}
+	return "", false
+}
+
+// prefixName returns the name prefixed with the nomadspace id
+func prefixName(id, name string) string {
+	return ns.Prefix(id, name)
+}
+
+// templateToken is a part of a template action: code, a string literal or
+// a comment
+type templateToken struct {
+	text    string
+	str     bool
+	comment bool
+}
+
+// scanAction splits the template action at the beginning of src into code,
+// string literal and comment tokens, and returns the position of the right
+// delimiter ending the action.
+func scanAction(src string) ([]templateToken, int) {
+	var tokens []templateToken
+	var start = 0
+	var i = 0
+	for i < len(src) && !strings.HasPrefix(src[i:], DefaultRightDelim) {
+		if strings.HasPrefix(src[i:], "/*") {
+			if i > start {
+				tokens = append(tokens, templateToken{text: src[start:i]})
+			}
+			j := strings.Index(src[i+2:], "*/")
+			if j < 0 {
+				j = len(src)
+			} else {
+				j += i + 4
+			}
+			tokens = append(tokens, templateToken{text: src[i:j], comment: true})
+			i = j
+			start = j
+			continue
+		}
+		quote := src[i]
+		if quote != '"' && quote != '`' && quote != '\'' {
+			i += 1
+			continue
+		}
+		if i > start {
+			tokens = append(tokens, templateToken{text: src[start:i]})
+		}
+		j := i + 1
+		for j < len(src) && src[j] != quote {
+			if src[j] == '\\' && quote != '`' {
+				j += 1
+			}
+			j += 1
+		}
+		if j < len(src) {
+			j += 1
+		}
+		tokens = append(tokens, templateToken{text: src[i:j], str: true})
+		i = j
+		start = j
+	}
+	if i > start {
+		tokens = append(tokens, templateToken{text: src[start:i]})
+	}
+	return tokens, i
+}
+
+// hasArgument returns true if the code following a template helper passes
+// it an argument, that is anything but the end of the action, of a
+// parenthesized expression or a pipe.
+func hasArgument(code string) bool {
+	code = strings.TrimSpace(code)
+	return code != "" && code != "-" && code[0] != '|' && code[0] != ')'
+}
+
+// isCommand returns true if a template helper preceded by the given code of
+// the action is the command of a pipeline, that receives arguments, and not
+// an argument itself.
+func isCommand(before string, first bool) bool {
+	before = strings.TrimSpace(before)
+	if before == "" || before == "-" {
+		return first
+	} else if strings.HasSuffix(before, "(") || strings.HasSuffix(before, "=") {
+		return true
+	}
+	fields := strings.Fields(before)
+	switch fields[len(fields)-1] {
+	case "if", "with", "range":
+		return true
+	}
+	return false
+}
+
+// expandAction replaces the template helpers in the action tokens with
+// string literals of their value. Helpers are expanded before consul-template
+// renders the template, their argument must be a string literal.
+func expandAction(space *NomadSpace, tokens []templateToken) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.str || tok.comment {
+			b.WriteString(tok.text)
+			continue
+		}
+		var pos = 0
+		for _, m := range templateHelperIdent.FindAllStringSubmatchIndex(tok.text, -1) {
+			name := tok.text[m[4]:m[5]]
+			b.WriteString(tok.text[pos:m[4]])
+			pos = m[5]
+
+			if strings.HasSuffix(strings.TrimSpace(tok.text[:m[4]]), "|") {
+				return "", fmt.Errorf("%v cannot be used in a pipeline, template helpers only accept a string literal argument", name)
+			}
+
+			var arg *string
+			var consumed = false
+			var literal = strings.TrimSpace(tok.text[m[5]:]) == "" && i+1 < len(tokens) && tokens[i+1].str
+			if !isCommand(tok.text[:m[4]], i == 0) {
+				// Helpers used as arguments are called without arguments
+				if templateHelperArgs[name] == "always" {
+					return "", fmt.Errorf("%v requires a string literal argument, use (%v \"name\") in arguments", name, name)
+				}
+			} else if templateHelperArgs[name] == "never" && (literal || hasArgument(tok.text[m[5]:])) {
+				return "", fmt.Errorf("%v does not accept an argument", name)
+			} else if templateHelperArgs[name] != "never" && literal {
+				s, err := strconv.Unquote(tokens[i+1].text)
+				if err != nil || tokens[i+1].text[0] == '\'' {
+					return "", fmt.Errorf("%v argument %v is not a valid string literal", name, tokens[i+1].text)
+				}
+				arg = &s
+				consumed = true
+			} else if templateHelperArgs[name] == "always" {
+				return "", fmt.Errorf("%v requires a string literal argument, template helpers are expanded before rendering", name)
+			} else if hasArgument(tok.text[m[5]:]) {
+				return "", fmt.Errorf("%v only accepts a string literal argument, template helpers are expanded before rendering", name)
+			}
+
+			res, _ := templateHelper(space, name, arg)
+			b.WriteString(strconv.Quote(res))
+			if consumed {
+				pos = len(tok.text)
+				i += 1
+			}
+		}
+		b.WriteString(tok.text[pos:])
+	}
+	return b.String(), nil
+}
+
+// expandTemplateHelpers replaces the nomadspace template helpers in the
+// template actions with string literals of their value. consul-template does
+// not allow to add template functions, this is done before templates are
+// given to consul-template.
+func expandTemplateHelpers(space *NomadSpace, src string) (string, error) {
+	var b strings.Builder
+	var line = 1
+	for {
+		start := strings.Index(src, DefaultLeftDelim)
+		if start < 0 {
+			b.WriteString(src)
+			break
+		}
+		start += len(DefaultLeftDelim)
+		b.WriteString(src[:start])
+		line += strings.Count(src[:start], "\n")
+		tokens, end := scanAction(src[start:])
+		action, err := expandAction(space, tokens)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %v: %v%v%v", line, err, DefaultLeftDelim, src[start:start+end], DefaultRightDelim)
+		}
+		b.WriteString(action)
+		line += strings.Count(src[start:start+end], "\n")
+		src = src[start+end:]
+	}
+	return b.String(), nil
+}
+
+// expandTemplateFile writes the template source file with expanded template
+// helpers to the rendered directory and returns its path. The file name is
+// kept.
+func expandTemplateFile(space *NomadSpace, fname string) (string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Join(space.RenderedDir, ".templates")
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := expandTemplateHelpers(space, string(data))
+	if err != nil {
+		return "", err
+	}
+
+	dst := path.Join(dir, path.Base(fname))
+	err = ioutil.WriteFile(dst, []byte(src), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
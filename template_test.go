@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mildred/nomadspace/ns"
+)
+
+func TestScanAction(t *testing.T) {
+	var tests = []struct {
+		src    string
+		tokens []templateToken
+		end    int
+	}{
+		{` ns ]] rest`, []templateToken{{text: " ns "}}, 4},
+		{`]]`, nil, 0},
+		{` childNs "a" ]]`, []templateToken{{text: " childNs "}, {text: `"a"`, str: true}, {text: " "}}, 13},
+		{` "a]]b" ]]`, []templateToken{{text: " "}, {text: `"a]]b"`, str: true}, {text: " "}}, 8},
+		{` "a\"]]" ]]`, []templateToken{{text: " "}, {text: `"a\"]]"`, str: true}, {text: " "}}, 9},
+		{" `a\\` ]]", []templateToken{{text: " "}, {text: "`a\\`", str: true}, {text: " "}}, 6},
+		{` '"' ]]`, []templateToken{{text: " "}, {text: `'"'`, str: true}, {text: " "}}, 5},
+		{`/* ns ]] */]]`, []templateToken{{text: `/* ns ]] */`, comment: true}}, 11},
+		{`- /* c */ -]]`, []templateToken{{text: "- "}, {text: `/* c */`, comment: true}, {text: " -"}}, 11},
+	}
+	for _, test := range tests {
+		tokens, end := scanAction(test.src)
+		if !reflect.DeepEqual(tokens, test.tokens) || end != test.end {
+			t.Errorf("scanAction(%q) = %#v, %d, expected %#v, %d", test.src, tokens, end, test.tokens, test.end)
+		}
+	}
+}
+
+func TestExpandTemplateHelpers(t *testing.T) {
+	var space = &NomadSpace{Id: "abc", Parent: "par", PrefixServices: true}
+	var q = func(s string) string {
+		return `"` + s + `"`
+	}
+	var tests = []struct {
+		src string
+		res string
+		err string
+	}{
+		{`no action`, `no action`, ""},
+		{`[[ ns ]]`, `[[ ` + q("abc") + ` ]]`, ""},
+		{`[[ ns "job" ]]`, `[[ ` + q(ns.Ns("job")) + ` ]]`, ""},
+		{`[[- nsPrefix -]]`, `[[- ` + q("abc-") + ` -]]`, ""},
+		{`[[ parentNs ]]`, `[[ ` + q("par") + ` ]]`, ""},
+		{`[[ childNs "db" ]]`, `[[ ` + q(ns.Child("abc", "db")) + ` ]]`, ""},
+		{`[[ nsService "web" ]]`, `[[ ` + q("abc-web") + ` ]]`, ""},
+		{"[[ childNs `db` ]]", `[[ ` + q(ns.Child("abc", "db")) + ` ]]`, ""},
+		{`[[ childNs "d\"b" ]]`, `[[ ` + q(ns.Child("abc", `d"b`)) + ` ]]`, ""},
+		{`[[ printf "%s" (childNs "db") ]]`, `[[ printf "%s" (` + q(ns.Child("abc", "db")) + `) ]]`, ""},
+		{`[[ ns | printf "%s-x" ]]`, `[[ ` + q("abc") + ` | printf "%s-x" ]]`, ""},
+		{`[[ if eq ns "abc" ]]a[[ end ]][[ nsPrefix ]]`, `[[ if eq ` + q("abc") + ` "abc" ]]a[[ end ]][[ ` + q("abc-") + ` ]]`, ""},
+		{`[[ "ns" ]] [[ .ns ]] [[ $ns ]] [[ nsx ]]`, `[[ "ns" ]] [[ .ns ]] [[ $ns ]] [[ nsx ]]`, ""},
+		{`[[/* childNs (env "X") */]]`, `[[/* childNs (env "X") */]]`, ""},
+		{`[[- /* ns */ -]]`, `[[- /* ns */ -]]`, ""},
+		{`[[ $c := childNs "db" ]][[ if childNs "db" ]][[ end ]]`, `[[ $c := ` + q(ns.Child("abc", "db")) + ` ]][[ if ` + q(ns.Child("abc", "db")) + ` ]][[ end ]]`, ""},
+		{`[[ printf "%s" childNs "db" ]]`, "", "line 1: childNs requires a string literal argument, use (childNs \"name\")"},
+		{`[[ childNs (env "X") ]]`, "", "line 1: childNs requires a string literal argument"},
+		{"a\n[[ \"db\" | childNs ]]", "", "line 2: childNs cannot be used in a pipeline"},
+		{`[[ ns (env "X") ]]`, "", "line 1: ns only accepts a string literal argument"},
+		{`[[ nsPrefix "x" ]]`, "", "line 1: nsPrefix does not accept an argument"},
+		{`[[ childNs ]]`, "", "line 1: childNs requires a string literal argument"},
+		{`[[ childNs 'd' ]]`, "", "line 1: childNs argument 'd' is not a valid string literal"},
+	}
+	for _, test := range tests {
+		res, err := expandTemplateHelpers(space, test.src)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("expandTemplateHelpers(%q) error %v, expected %q", test.src, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("expandTemplateHelpers(%q) unexpected error %v", test.src, err)
+		} else if res != test.res {
+			t.Errorf("expandTemplateHelpers(%q) = %q, expected %q", test.src, res, test.res)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// vaultOptions are the Vault connection settings. Empty settings keep the
+// defaults from the VAULT_* environment variables.
+type vaultOptions struct {
+	Addr       string
+	Token      string
+	RoleID     string
+	SecretID   string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+}
+
+// client returns a Vault API client, logged in with AppRole if a role id is
+// given
+func (o *vaultOptions) client() (*vaultapi.Client, error) {
+	var cfg = vaultapi.DefaultConfig()
+	if o.Addr != "" {
+		cfg.Address = o.Addr
+	}
+	if o.CACert != "" || o.ClientCert != "" || o.ClientKey != "" {
+		err := cfg.ConfigureTLS(&vaultapi.TLSConfig{
+			CACert:     o.CACert,
+			ClientCert: o.ClientCert,
+			ClientKey:  o.ClientKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Token != "" && o.RoleID != "" {
+		return nil, fmt.Errorf("Cannot set both --vault-token and --vault-role-id")
+	} else if o.Token != "" {
+		client.SetToken(o.Token)
+	} else if o.RoleID != "" {
+		secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   o.RoleID,
+			"secret_id": o.SecretID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to login to Vault with AppRole, %v", err)
+		} else if secret == nil || secret.Auth == nil {
+			return nil, fmt.Errorf("failed to login to Vault with AppRole, no token returned")
+		}
+		client.SetToken(secret.Auth.ClientToken)
+	}
+
+	return client, nil
+}
+
+// templateConfig returns the consul-template Vault configuration, using the
+// token of the Vault client if any
+func (o *vaultOptions) templateConfig(client *vaultapi.Client) *config.VaultConfig {
+	var cfg = config.DefaultVaultConfig()
+	if o.Addr != "" {
+		cfg.Address = config.String(o.Addr)
+	}
+	if client != nil && client.Token() != "" {
+		cfg.Token = config.String(client.Token())
+	}
+	if o.CACert != "" {
+		cfg.SSL.CaCert = config.String(o.CACert)
+	}
+	if o.ClientCert != "" {
+		cfg.SSL.Cert = config.String(o.ClientCert)
+	}
+	if o.ClientKey != "" {
+		cfg.SSL.Key = config.String(o.ClientKey)
+	}
+	return cfg
+}
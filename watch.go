@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+)
+
+var errChanged = errors.New("input directory changed")
+
+// ignoreChange returns true for files that are never part of the nomadspace
+// such as hidden files and editor backup files.
+func ignoreChange(fname string) bool {
+	name := path.Base(fname)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")
+}
+
+// watchDir watches the directory for changes and signals them on the
+// returned channel. Changes are debounced: the signal is only sent once no
+// change happened for the given delay.
+func watchDir(ctx context.Context, l hclog.Logger, dir string, delay time.Duration) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(delay)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event := <-watcher.Events:
+				if ignoreChange(event.Name) {
+					continue
+				}
+				l.Debug("Watch event", "event", event.String())
+				timer.Reset(delay)
+			case err := <-watcher.Errors:
+				l.Error("Watch failed", "error", err)
+			case <-timer.C:
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}